@@ -0,0 +1,88 @@
+package gochinadns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Modes to reply queries hitting domain blacklist.
+const (
+	BlockEmpty    = "empty"    // empty NOERROR reply
+	BlockNXDomain = "nxdomain" // NXDOMAIN with SOA
+	BlockRefused  = "refused"  // REFUSED
+	BlockNoData   = "nodata"   // NOERROR with SOA and no answers
+	BlockNullIP   = "null"     // 0.0.0.0 for A and :: for AAAA, NODATA with SOA for other types
+)
+
+// parseBlockMode parses block mode, which is one of the Block* modes, or comma separated sinkhole IPs
+// which are answered like BlockNullIP.
+func parseBlockMode(mode string) (kind string, ipv4, ipv6 net.IP, err error) {
+	switch mode = strings.ToLower(strings.TrimSpace(mode)); mode {
+	case BlockEmpty, BlockNXDomain, BlockRefused, BlockNoData:
+		return mode, nil, nil, nil
+	case BlockNullIP:
+		return mode, net.IPv4zero, net.IPv6zero, nil
+	}
+
+	for _, s := range strings.Split(mode, ",") {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		switch {
+		case ip == nil:
+			return "", nil, nil, fmt.Errorf("invalid block mode %q, should be one of %s, %s, %s, %s, %s or sinkhole IPs",
+				mode, BlockEmpty, BlockNXDomain, BlockRefused, BlockNoData, BlockNullIP)
+		case ip.To4() != nil:
+			ipv4 = ip
+		default:
+			ipv6 = ip
+		}
+	}
+	return BlockNullIP, ipv4, ipv6, nil
+}
+
+// blockReply generates the reply to req which hits domain blacklist.
+func (s *Server) blockReply(req *dns.Msg) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	q := req.Question[0]
+	ttl := uint32(s.BlockTTL / time.Second)
+
+	switch s.BlockMode {
+	case BlockNXDomain:
+		reply.Rcode = dns.RcodeNameError
+		reply.Ns = append(reply.Ns, blockSOA(q.Name, ttl))
+	case BlockRefused:
+		reply.Rcode = dns.RcodeRefused
+	case BlockNoData:
+		reply.Ns = append(reply.Ns, blockSOA(q.Name, ttl))
+	case BlockNullIP:
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: ttl}
+		switch {
+		case q.Qtype == dns.TypeA && s.blockIPv4 != nil:
+			reply.Answer = append(reply.Answer, &dns.A{Hdr: hdr, A: s.blockIPv4})
+		case q.Qtype == dns.TypeAAAA && s.blockIPv6 != nil:
+			reply.Answer = append(reply.Answer, &dns.AAAA{Hdr: hdr, AAAA: s.blockIPv6})
+		default:
+			reply.Ns = append(reply.Ns, blockSOA(q.Name, ttl))
+		}
+	}
+	return reply
+}
+
+// blockSOA generates the SOA record in authority section of negative replies to blocked domain name,
+// so that clients can cache them for ttl (RFC 2308).
+func blockSOA(name string, ttl uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "blocked.chinadns.invalid.",
+		Mbox:    "hostmaster.chinadns.invalid.",
+		Serial:  1,
+		Refresh: 1800,
+		Retry:   900,
+		Expire:  604800,
+		Minttl:  ttl,
+	}
+}
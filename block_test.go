@@ -0,0 +1,94 @@
+package gochinadns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseBlockMode(t *testing.T) {
+	tests := []struct {
+		mode       string
+		kind       string
+		ipv4, ipv6 net.IP
+		err        bool
+	}{
+		{mode: "empty", kind: BlockEmpty},
+		{mode: "NXDOMAIN", kind: BlockNXDomain},
+		{mode: "refused", kind: BlockRefused},
+		{mode: "nodata", kind: BlockNoData},
+		{mode: "null", kind: BlockNullIP, ipv4: net.IPv4zero, ipv6: net.IPv6zero},
+		{mode: "10.0.0.1", kind: BlockNullIP, ipv4: net.ParseIP("10.0.0.1")},
+		{mode: "10.0.0.1, fd00::1", kind: BlockNullIP, ipv4: net.ParseIP("10.0.0.1"), ipv6: net.ParseIP("fd00::1")},
+		{mode: "drop", err: true},
+		{mode: "10.0.0.1,", err: true},
+	}
+	for _, tt := range tests {
+		kind, ipv4, ipv6, err := parseBlockMode(tt.mode)
+		if (err != nil) != tt.err {
+			t.Errorf("parseBlockMode(%q) error = %v, want error %v", tt.mode, err, tt.err)
+			continue
+		}
+		if kind != tt.kind || !ipv4.Equal(tt.ipv4) || !ipv6.Equal(tt.ipv6) {
+			t.Errorf("parseBlockMode(%q) = %s, %s, %s, want %s, %s, %s", tt.mode, kind, ipv4, ipv6, tt.kind, tt.ipv4, tt.ipv6)
+		}
+	}
+}
+
+func TestBlockReply(t *testing.T) {
+	newServer := func(mode string) *Server {
+		s, err := NewServer(NewClient(), WithBlockMode(mode), WithBlockTTL(5*time.Minute), WithSkipRefineResolvers(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	query := func(qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("ads.example.com.", qtype)
+		return req
+	}
+
+	reply := newServer(BlockEmpty).blockReply(query(dns.TypeA))
+	if reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 0 || len(reply.Ns) != 0 {
+		t.Errorf("Reply should be empty in empty mode, got %v", reply)
+	}
+
+	reply = newServer(BlockNXDomain).blockReply(query(dns.TypeA))
+	if reply.Rcode != dns.RcodeNameError || len(reply.Ns) != 1 {
+		t.Fatalf("Reply should be NXDOMAIN with SOA in nxdomain mode, got %v", reply)
+	}
+	if soa := reply.Ns[0].(*dns.SOA); soa.Hdr.Ttl != 300 || soa.Minttl != 300 {
+		t.Errorf("TTL of SOA should be 300, got %d and minimum %d", soa.Hdr.Ttl, soa.Minttl)
+	}
+
+	if reply = newServer(BlockRefused).blockReply(query(dns.TypeA)); reply.Rcode != dns.RcodeRefused {
+		t.Errorf("Reply should be REFUSED in refused mode, got %v", reply)
+	}
+
+	reply = newServer(BlockNoData).blockReply(query(dns.TypeA))
+	if reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 0 || len(reply.Ns) != 1 {
+		t.Errorf("Reply should be NODATA with SOA in nodata mode, got %v", reply)
+	}
+
+	s := newServer(BlockNullIP)
+	if reply = s.blockReply(query(dns.TypeA)); len(reply.Answer) != 1 || !reply.Answer[0].(*dns.A).A.Equal(net.IPv4zero) {
+		t.Errorf("A query should be answered 0.0.0.0 in null mode, got %v", reply)
+	}
+	if reply = s.blockReply(query(dns.TypeAAAA)); len(reply.Answer) != 1 || !reply.Answer[0].(*dns.AAAA).AAAA.Equal(net.IPv6zero) {
+		t.Errorf("AAAA query should be answered :: in null mode, got %v", reply)
+	}
+	if reply = s.blockReply(query(dns.TypeMX)); len(reply.Answer) != 0 || len(reply.Ns) != 1 {
+		t.Errorf("MX query should be answered NODATA in null mode, got %v", reply)
+	}
+
+	s = newServer("10.0.0.1")
+	if reply = s.blockReply(query(dns.TypeA)); len(reply.Answer) != 1 || reply.Answer[0].Header().Ttl != 300 {
+		t.Errorf("A query should be answered sinkhole IP with TTL 300, got %v", reply)
+	}
+	if reply = s.blockReply(query(dns.TypeAAAA)); len(reply.Answer) != 0 || len(reply.Ns) != 1 {
+		t.Errorf("AAAA query should be answered NODATA without IPv6 sinkhole, got %v", reply)
+	}
+}
@@ -1,8 +1,274 @@
 package gochinadns
 
-var (
-// flagDisableCache    = flag.Bool("disable-cache", false, "Disable built-in DNS cache.")
-// flagMaxCacheEntries = flag.Int("cache-entries", 5000, "Max DNS cache entries.")
-// flagCacheTTL        = flag.Duration("cache-ttl", 0, "Cache TTL. Set to 0 to use TTL in DNS answers.")
-// flagLazyExpire      = flag.Bool("lazy-expire", true, "In lazy mode, cache could still be used when DNS timeout happens, even if it was expired.")
+import (
+	"container/list"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
 )
+
+// cacheKey generates the cache key of a DNS request, composed of qname, qtype, qclass and DO bit.
+func cacheKey(req *dns.Msg) string {
+	q := req.Question[0]
+	do := false
+	if e := req.IsEdns0(); e != nil {
+		do = e.Do()
+	}
+
+	sb := new(strings.Builder)
+	sb.WriteString(strings.ToLower(dns.Fqdn(q.Name)))
+	sb.WriteByte(' ')
+	sb.WriteString(strconv.Itoa(int(q.Qtype)))
+	sb.WriteByte(' ')
+	sb.WriteString(strconv.Itoa(int(q.Qclass)))
+	if do {
+		sb.WriteString(" DO")
+	}
+	return sb.String()
+}
+
+const (
+	// staleTTL is the TTL of stale answers, recommended by https://tools.ietf.org/html/rfc8767#section-4
+	staleTTL = 30
+	// maxStale is the max period an expired entry can be served as a stale answer.
+	maxStale = 3 * 24 * time.Hour
+)
+
+type cacheEntry struct {
+	key    string
+	msg    *dns.Msg
+	stored time.Time
+	expire time.Time
+
+	hits        int  // hits since stored
+	prefetching bool // whether a prefetch is triggered
+}
+
+// lruCache is a bounded LRU cache of DNS replies. It is safe for concurrent use.
+type lruCache struct {
+	sync.Mutex
+	capacity int
+	ttl      time.Duration // Fixed TTL for all entries. 0 means using TTL in DNS answers.
+	lazy     bool          // Keep expired entries until they are evicted.
+
+	prefetchHits   int           // Hits to trigger prefetch. 0 means disabled.
+	prefetchWindow time.Duration // Trigger prefetch if the remaining TTL is less than this window.
+	negativeMaxTTL time.Duration // Max TTL of negative answers. 0 means negative caching is disabled.
+
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func newLRUCache(capacity int, ttl time.Duration, lazy bool) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		ttl:      ttl,
+		lazy:     lazy,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns a copy of the cached reply with TTLs decremented, or nil if not found or expired.
+// prefetch reports whether the caller should refresh this entry in background.
+// It is reported only once per entry.
+func (c *lruCache) Get(key string) (reply *dns.Msg, prefetch bool) {
+	if c == nil {
+		return
+	}
+	now := time.Now()
+
+	c.Lock()
+	defer c.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !now.Before(entry.expire) {
+		if !c.lazy {
+			c.remove(elem)
+		}
+		return
+	}
+	c.ll.MoveToFront(elem)
+
+	entry.hits++
+	if c.prefetchHits > 0 && !entry.prefetching && entry.hits >= c.prefetchHits &&
+		entry.expire.Sub(now) < c.prefetchWindow {
+		entry.prefetching = true
+		prefetch = true
+	}
+	return entry.reply(now), prefetch
+}
+
+// GetStale returns a copy of the cached reply even if it was expired, which is known as serve-stale.
+// See https://tools.ietf.org/html/rfc8767 . Stale answers are served with a short TTL.
+// It returns nil if the cache is not in lazy mode.
+func (c *lruCache) GetStale(key string) *dns.Msg {
+	if c == nil || !c.lazy {
+		return nil
+	}
+	now := time.Now()
+
+	c.Lock()
+	defer c.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if now.Before(entry.expire) {
+		c.ll.MoveToFront(elem)
+		return entry.reply(now)
+	}
+	if now.Sub(entry.expire) > maxStale {
+		c.remove(elem)
+		return nil
+	}
+	c.ll.MoveToFront(elem)
+	msg := entry.msg.Copy()
+	setTTL(msg, staleTTL)
+	return msg
+}
+
+// Set stores a copy of reply in cache. Replies which can not be cached are ignored.
+func (c *lruCache) Set(key string, reply *dns.Msg) {
+	if c == nil || c.capacity <= 0 || !cacheable(reply) {
+		return
+	}
+
+	var (
+		msg = reply.Copy()
+		ttl time.Duration
+	)
+	if reply.Rcode == dns.RcodeSuccess && len(reply.Answer) > 0 {
+		if ttl = c.ttl; ttl > 0 {
+			setTTL(msg, uint32(ttl/time.Second))
+		} else {
+			ttl = time.Duration(minTTL(msg)) * time.Second
+		}
+	} else if c.negativeMaxTTL > 0 {
+		ttl = time.Duration(negativeTTL(msg)) * time.Second
+		if ttl > c.negativeMaxTTL {
+			ttl = c.negativeMaxTTL
+		}
+		setTTL(msg, uint32(ttl/time.Second))
+	}
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	entry := &cacheEntry{key: key, msg: msg, stored: now, expire: now.Add(ttl)}
+
+	c.Lock()
+	defer c.Unlock()
+	if elem, ok := c.items[key]; ok {
+		elem.Value = entry
+		c.ll.MoveToFront(elem)
+		return
+	}
+	c.items[key] = c.ll.PushFront(entry)
+	for c.ll.Len() > c.capacity {
+		c.remove(c.ll.Back())
+	}
+}
+
+// Len returns the number of entries in cache.
+func (c *lruCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.ll.Len()
+}
+
+// Flush removes all entries, including stale ones.
+func (c *lruCache) Flush() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+func (c *lruCache) remove(elem *list.Element) {
+	c.ll.Remove(elem)
+	delete(c.items, elem.Value.(*cacheEntry).key)
+}
+
+// reply returns a copy of the cached message whose TTLs are decremented by the time elapsed.
+func (e *cacheEntry) reply(now time.Time) *dns.Msg {
+	msg := e.msg.Copy()
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl > elapsed {
+				hdr.Ttl -= elapsed
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+	return msg
+}
+
+func cacheable(reply *dns.Msg) bool {
+	return reply != nil && !reply.Truncated
+}
+
+// negativeTTL returns the TTL of a negative answer (NXDOMAIN or NODATA), which is the minimum of
+// the SOA record's TTL and its MINIMUM field. It returns 0 if reply is not a negative answer with SOA.
+// Negative Caching of DNS Queries: https://tools.ietf.org/html/rfc2308#section-5
+func negativeTTL(reply *dns.Msg) uint32 {
+	if reply.Rcode != dns.RcodeNameError && (reply.Rcode != dns.RcodeSuccess || len(reply.Answer) > 0) {
+		return 0
+	}
+	for _, rr := range reply.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if soa.Minttl < soa.Hdr.Ttl {
+				return soa.Minttl
+			}
+			return soa.Hdr.Ttl
+		}
+	}
+	return 0
+}
+
+// minTTL returns the minimum TTL of all resource records except OPT in msg.
+func minTTL(msg *dns.Msg) (ttl uint32) {
+	first := true
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if first || hdr.Ttl < ttl {
+				ttl = hdr.Ttl
+				first = false
+			}
+		}
+	}
+	return
+}
+
+func setTTL(msg *dns.Msg, ttl uint32) {
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+				hdr.Ttl = ttl
+			}
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package gochinadns
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestReply(name string, ttl uint32) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.Answer = append(reply.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.ParseIP("1.2.3.4"),
+	})
+	return reply
+}
+
+func getReply(c *lruCache, key string) *dns.Msg {
+	reply, _ := c.Get(key)
+	return reply
+}
+
+func TestCacheKey(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("Example.COM.", dns.TypeA)
+	req2 := new(dns.Msg)
+	req2.SetQuestion("example.com.", dns.TypeA)
+	if cacheKey(req) != cacheKey(req2) {
+		t.Error("Cache key should be case insensitive")
+	}
+
+	req2.SetEdns0(4096, true)
+	if cacheKey(req) == cacheKey(req2) {
+		t.Error("Cache key should differ in DO bit")
+	}
+
+	req2.SetQuestion("example.com.", dns.TypeAAAA)
+	if cacheKey(req) == cacheKey(req2) {
+		t.Error("Cache key should differ in qtype")
+	}
+}
+
+func TestCacheGetSet(t *testing.T) {
+	c := newLRUCache(2, 0, false)
+	if getReply(c, "a") != nil {
+		t.Error("An empty cache contains nothing")
+	}
+
+	c.Set("a", newTestReply("a.com", 60))
+	c.Set("b", newTestReply("b.com", 60))
+	if getReply(c, "a") == nil {
+		t.Error("a should be cached")
+	}
+	c.Set("c", newTestReply("c.com", 60))
+	if c.Len() != 2 {
+		t.Errorf("Cache length should be 2, got %d", c.Len())
+	}
+	if getReply(c, "b") != nil {
+		t.Error("b is the least recently used and should be evicted")
+	}
+	if getReply(c, "a") == nil || getReply(c, "c") == nil {
+		t.Error("a and c should be cached")
+	}
+
+	c.Set("d", newTestReply("d.com", 0))
+	if getReply(c, "d") != nil {
+		t.Error("Reply with zero TTL should not be cached")
+	}
+	empty := new(dns.Msg)
+	empty.SetQuestion("e.com.", dns.TypeA)
+	c.Set("e", empty)
+	if getReply(c, "e") != nil {
+		t.Error("Reply without answers should not be cached")
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := newLRUCache(10, 0, false)
+	c.Set("a", newTestReply("a.com", 60))
+	entry := c.items["a"].Value.(*cacheEntry)
+	entry.stored = entry.stored.Add(-10 * time.Second)
+
+	reply := getReply(c, "a")
+	if reply == nil {
+		t.Fatal("a should be cached")
+	}
+	if ttl := reply.Answer[0].Header().Ttl; ttl != 50 {
+		t.Errorf("TTL should be decremented to 50, got %d", ttl)
+	}
+
+	entry.expire = time.Now()
+	if getReply(c, "a") != nil {
+		t.Error("Expired entry should not be returned")
+	}
+	if c.Len() != 0 {
+		t.Error("Expired entry should be removed in non-lazy mode")
+	}
+
+	c = newLRUCache(10, 0, true)
+	c.Set("a", newTestReply("a.com", 60))
+	c.items["a"].Value.(*cacheEntry).expire = time.Now()
+	if getReply(c, "a") != nil || c.Len() != 1 {
+		t.Error("Expired entry should be kept but not returned in lazy mode")
+	}
+
+	c = newLRUCache(10, 5*time.Second, false)
+	c.Set("a", newTestReply("a.com", 60))
+	if ttl := getReply(c, "a").Answer[0].Header().Ttl; ttl != 5 {
+		t.Errorf("TTL should be overridden to 5, got %d", ttl)
+	}
+}
+
+func TestCacheGetStale(t *testing.T) {
+	c := newLRUCache(10, 0, false)
+	c.Set("a", newTestReply("a.com", 60))
+	c.items["a"].Value.(*cacheEntry).expire = time.Now()
+	if c.GetStale("a") != nil {
+		t.Error("Stale entry should not be served in non-lazy mode")
+	}
+
+	c = newLRUCache(10, 0, true)
+	c.Set("a", newTestReply("a.com", 60))
+	if ttl := c.GetStale("a").Answer[0].Header().Ttl; ttl != 60 {
+		t.Errorf("Fresh entry should keep its TTL, got %d", ttl)
+	}
+
+	entry := c.items["a"].Value.(*cacheEntry)
+	entry.expire = time.Now()
+	reply := c.GetStale("a")
+	if reply == nil {
+		t.Fatal("Stale entry should be served in lazy mode")
+	}
+	if ttl := reply.Answer[0].Header().Ttl; ttl != staleTTL {
+		t.Errorf("Stale answer TTL should be %d, got %d", staleTTL, ttl)
+	}
+
+	entry.expire = time.Now().Add(-maxStale - time.Second)
+	if c.GetStale("a") != nil || c.Len() != 0 {
+		t.Error("Entry expired too long ago should be removed")
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	c := newLRUCache(10, 0, false)
+	c.prefetchHits, c.prefetchWindow = 2, 10*time.Second
+	c.Set("a", newTestReply("a.com", 5))
+	c.Set("b", newTestReply("b.com", 60))
+
+	if _, prefetch := c.Get("a"); prefetch {
+		t.Error("Prefetch should not be triggered before enough hits")
+	}
+	if _, prefetch := c.Get("a"); !prefetch {
+		t.Error("Prefetch should be triggered for a popular entry close to expiry")
+	}
+	if _, prefetch := c.Get("a"); prefetch {
+		t.Error("Prefetch should be triggered only once")
+	}
+
+	c.Get("b")
+	if _, prefetch := c.Get("b"); prefetch {
+		t.Error("Prefetch should not be triggered for an entry far from expiry")
+	}
+
+	c.Set("a", newTestReply("a.com", 5))
+	c.Get("a")
+	if _, prefetch := c.Get("a"); !prefetch {
+		t.Error("Prefetch should be triggered again after the entry is refreshed")
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	soa := func(ttl, minttl uint32) dns.RR {
+		return &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+			Ns:     "a.gtld-servers.net.",
+			Mbox:   "nstld.verisign-grs.com.",
+			Minttl: minttl,
+		}
+	}
+	nxdomain := new(dns.Msg)
+	nxdomain.SetQuestion("nx.com.", dns.TypeA)
+	nxdomain.Rcode = dns.RcodeNameError
+	nodata := nxdomain.Copy()
+	nodata.Rcode = dns.RcodeSuccess
+
+	c := newLRUCache(10, 0, false)
+	c.Set("nx", nxdomain)
+	if getReply(c, "nx") != nil {
+		t.Error("Negative answer should not be cached when negative caching is disabled")
+	}
+
+	c.negativeMaxTTL = time.Hour
+	c.Set("nx", nxdomain)
+	if getReply(c, "nx") != nil {
+		t.Error("Negative answer without SOA should not be cached")
+	}
+
+	nxdomain.Ns = []dns.RR{soa(900, 300)}
+	c.Set("nx", nxdomain)
+	reply := getReply(c, "nx")
+	if reply == nil || reply.Rcode != dns.RcodeNameError {
+		t.Fatal("NXDOMAIN should be cached")
+	}
+	if ttl := reply.Ns[0].Header().Ttl; ttl != 300 {
+		t.Errorf("Negative TTL should be the SOA minimum 300, got %d", ttl)
+	}
+
+	nodata.Ns = []dns.RR{soa(86400, 86400)}
+	c.Set("nodata", nodata)
+	reply = getReply(c, "nodata")
+	if reply == nil {
+		t.Fatal("NODATA should be cached")
+	}
+	if ttl := reply.Ns[0].Header().Ttl; ttl != 3600 {
+		t.Errorf("Negative TTL should be capped to 3600, got %d", ttl)
+	}
+
+	servfail := nodata.Copy()
+	servfail.Rcode = dns.RcodeServerFailure
+	c.Set("servfail", servfail)
+	if getReply(c, "servfail") != nil {
+		t.Error("SERVFAIL should not be cached")
+	}
+}
+
+func TestServerNotCacheFallback(t *testing.T) {
+	chnList := filepath.Join(t.TempDir(), "china.list")
+	if err := os.WriteFile(chnList, []byte("127.0.0.1/32\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	silent, _ := startSilentUpstream(t)
+	s, err := NewServer(NewClient(WithTimeout(200*time.Millisecond)),
+		WithCHNList(chnList),
+		WithResolvers(false, "udp@"+startUpstream(t, answerHandler("8.8.8.8"))),
+		WithTrustedResolvers(false, "udp@"+silent),
+		WithDelay(50*time.Millisecond),
+		WithSkipRefineResolvers(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	w := new(testWriter)
+	s.Serve(w, req)
+	if w.reply == nil || len(w.reply.Answer) != 1 {
+		t.Fatalf("Untrusted answer should be served as fallback, got %v", w.reply)
+	}
+	if cached, _ := s.cache.Get(cacheKey(req)); cached != nil {
+		t.Error("Fallback reply should not be cached")
+	}
+}
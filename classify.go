@@ -0,0 +1,129 @@
+package gochinadns
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Policies to classify IPs in answers as in China.
+const (
+	PolicyAll      = "all"      // all IPs are in China
+	PolicyAny      = "any"      // any IP is in China
+	PolicyMajority = "majority" // more than half of IPs are in China
+)
+
+func checkClassifyPolicy(policy string) error {
+	switch policy {
+	case PolicyAll, PolicyAny, PolicyMajority:
+		return nil
+	}
+	return fmt.Errorf("invalid classify policy %q, should be one of %s, %s and %s", policy, PolicyAll, PolicyAny, PolicyMajority)
+}
+
+// answerIPs returns IPs in A and AAAA records of the answer section.
+func answerIPs(msg *dns.Msg) []net.IP {
+	var ips []net.IP
+	for _, rr := range msg.Answer {
+		switch answer := rr.(type) {
+		case *dns.A:
+			ips = append(ips, answer.A)
+		case *dns.AAAA:
+			ips = append(ips, answer.AAAA)
+		}
+	}
+	return ips
+}
+
+// filterBlacklisted checks ips of rep against IP blacklist. If none is blacklisted, it returns rep and ips as is.
+// Otherwise, it returns a copy of rep with the blacklisted stripped and the remaining IPs if StripBlacklisted is set,
+// or rep and no IPs, which means rep should be dropped. A stripped reply without IPs is still returned,
+// so that it instead of the polluted one is served as fallback.
+func (s *Server) filterBlacklisted(
+	logger *logrus.Entry, trace *queryTrace, rules *ruleLists, rep *upstreamReply, ips []net.IP,
+) (*upstreamReply, []net.IP) {
+	var remains, blacklisted []net.IP
+	for _, ip := range ips {
+		hit, err := rules.IPBlacklist.Contains(ip)
+		if err != nil {
+			logger.WithError(err).Error("Blacklist CIDR error.")
+		}
+		if hit {
+			s.metrics.observeBlacklist("ip")
+			trace.addBlacklisted(ip)
+			blacklisted = append(blacklisted, ip)
+		} else {
+			remains = append(remains, ip)
+		}
+	}
+
+	switch {
+	case len(blacklisted) == 0:
+		return rep, ips
+	case !s.StripBlacklisted:
+		return rep, nil
+	}
+	logger.WithField("blacklisted", blacklisted).Debug("Strip blacklisted answers.")
+	return &upstreamReply{Msg: stripIPs(rep.Msg, blacklisted), Server: rep.Server}, remains
+}
+
+// stripIPs returns a copy of msg without A and AAAA records of ips in the answer and additional sections.
+// Other records like CNAME are kept.
+func stripIPs(msg *dns.Msg, ips []net.IP) *dns.Msg {
+	contains := func(ip net.IP) bool {
+		for _, e := range ips {
+			if e.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	strip := func(rrs []dns.RR) []dns.RR {
+		kept := rrs[:0]
+		for _, rr := range rrs {
+			switch answer := rr.(type) {
+			case *dns.A:
+				if contains(answer.A) {
+					continue
+				}
+			case *dns.AAAA:
+				if contains(answer.AAAA) {
+					continue
+				}
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+
+	msg = msg.Copy()
+	msg.Answer = strip(msg.Answer)
+	msg.Extra = strip(msg.Extra)
+	return msg
+}
+
+// inChina classifies ips as in China or not by ClassifyPolicy.
+func (s *Server) inChina(logger *logrus.Entry, rules *ruleLists, ips []net.IP) bool {
+	var count int
+	for _, ip := range ips {
+		contain, err := rules.ChinaCIDR.Contains(ip)
+		if err != nil {
+			logger.WithError(err).Error("CIDR error.")
+		}
+		if contain {
+			count++
+		}
+	}
+
+	switch s.ClassifyPolicy {
+	case PolicyAny:
+		return count > 0
+	case PolicyMajority:
+		return count*2 > len(ips)
+	default:
+		return count == len(ips)
+	}
+}
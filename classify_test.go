@@ -0,0 +1,179 @@
+package gochinadns
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/yl2chen/cidranger"
+)
+
+func newTestAnswer(ips ...string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion("a.com.", dns.TypeA)
+	msg.Answer = append(msg.Answer, &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: "a.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+		Target: "b.com.",
+	})
+	for _, ip := range ips {
+		hdr := dns.RR_Header{Name: "b.com.", Class: dns.ClassINET, Ttl: 60}
+		if v4 := net.ParseIP(ip).To4(); v4 != nil {
+			hdr.Rrtype = dns.TypeA
+			msg.Answer = append(msg.Answer, &dns.A{Hdr: hdr, A: v4})
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			msg.Answer = append(msg.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP(ip)})
+		}
+	}
+	return msg
+}
+
+func newTestRanger(t *testing.T, cidrs ...string) cidranger.Ranger {
+	ranger := cidranger.NewPCTrieRanger()
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ranger.Insert(cidranger.NewBasicRangerEntry(*network)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ranger
+}
+
+func TestAnswerIPs(t *testing.T) {
+	ips := answerIPs(newTestAnswer("1.1.1.1", "::1"))
+	if want := []net.IP{net.ParseIP("1.1.1.1").To4(), net.ParseIP("::1")}; !reflect.DeepEqual(ips, want) {
+		t.Errorf("Answer IPs should be %v, got %v", want, ips)
+	}
+	if ips := answerIPs(newTestAnswer()); len(ips) != 0 {
+		t.Errorf("CNAME only answer should have no IPs, got %v", ips)
+	}
+}
+
+func TestInChina(t *testing.T) {
+	rules := &ruleLists{ChinaCIDR: newTestRanger(t, "1.0.0.0/8")}
+	logger := logrus.NewEntry(logrus.StandardLogger())
+	parse := func(ips ...string) (result []net.IP) {
+		for _, ip := range ips {
+			result = append(result, net.ParseIP(ip))
+		}
+		return
+	}
+
+	tests := []struct {
+		ips                []net.IP
+		all, any, majority bool
+	}{
+		{parse("1.1.1.1", "1.2.2.2"), true, true, true},
+		{parse("1.1.1.1", "1.2.2.2", "8.8.8.8"), false, true, true},
+		{parse("1.1.1.1", "8.8.8.8"), false, true, false},
+		{parse("8.8.8.8", "8.8.4.4"), false, false, false},
+	}
+	for _, tt := range tests {
+		for policy, want := range map[string]bool{PolicyAll: tt.all, PolicyAny: tt.any, PolicyMajority: tt.majority} {
+			s := &Server{serverOptions: &serverOptions{ClassifyPolicy: policy}}
+			if got := s.inChina(logger, rules, tt.ips); got != want {
+				t.Errorf("%v in China by policy %s should be %v, got %v", tt.ips, policy, want, got)
+			}
+		}
+	}
+}
+
+func TestFilterBlacklisted(t *testing.T) {
+	rules := &ruleLists{IPBlacklist: newTestRanger(t, "4.0.0.0/8", "2001:db8::/32")}
+	logger := logrus.NewEntry(logrus.StandardLogger())
+	rep := &upstreamReply{Msg: newTestAnswer("1.1.1.1", "4.4.4.4", "2001:db8::1")}
+	ips := answerIPs(rep.Msg)
+
+	s := &Server{serverOptions: &serverOptions{}}
+	trace := new(queryTrace)
+	reply, remains := s.filterBlacklisted(logger, trace, rules, rep, ips)
+	if reply != rep || len(remains) != 0 {
+		t.Errorf("Answer hitting blacklist should be dropped, got %v", remains)
+	}
+	if len(trace.Blacklisted) != 2 {
+		t.Errorf("Blacklisted IPs should be traced, got %v", trace.Blacklisted)
+	}
+
+	s.StripBlacklisted = true
+	reply, remains = s.filterBlacklisted(logger, new(queryTrace), rules, rep, ips)
+	if !reflect.DeepEqual(remains, ips[:1]) {
+		t.Errorf("Remaining IPs should be %v, got %v", ips[:1], remains)
+	}
+	if len(reply.Answer) != 2 || reply.Answer[0].Header().Rrtype != dns.TypeCNAME || !reflect.DeepEqual(answerIPs(reply.Msg), ips[:1]) {
+		t.Errorf("Blacklisted IPs should be stripped with CNAME kept, got %v", reply.Answer)
+	}
+	if len(rep.Answer) != 4 {
+		t.Error("Original answer should not be modified")
+	}
+
+	rep = &upstreamReply{Msg: newTestAnswer("4.4.4.4")}
+	reply, remains = s.filterBlacklisted(logger, new(queryTrace), rules, rep, answerIPs(rep.Msg))
+	if len(remains) != 0 {
+		t.Errorf("Answer with all IPs blacklisted should be dropped, got %v", remains)
+	}
+	if len(reply.Answer) != 1 || reply.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Errorf("Answer with all IPs blacklisted should be stripped for fallback, got %v", reply.Answer)
+	}
+
+	rep = &upstreamReply{Msg: newTestAnswer("1.1.1.1")}
+	if reply, _ = s.filterBlacklisted(logger, new(queryTrace), rules, rep, answerIPs(rep.Msg)); reply != rep {
+		t.Error("Answer without blacklisted IPs should not be copied")
+	}
+}
+
+func TestServerStripBlacklisted(t *testing.T) {
+	dir := t.TempDir()
+	chnList := filepath.Join(dir, "china.list")
+	blacklist := filepath.Join(dir, "blacklist.list")
+	for path, content := range map[string]string{
+		chnList:   "1.0.0.0/8\n127.0.0.1/32\n",
+		blacklist: "4.4.4.4/32\n",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		answers []string
+		strip   bool
+		want    []net.IP
+		branch  string
+	}{
+		{[]string{"1.1.1.1", "4.4.4.4"}, true, []net.IP{net.ParseIP("1.1.1.1").To4()}, branchUntrusted},
+		{[]string{"4.4.4.4"}, true, nil, branchFallback},
+		{[]string{"1.1.1.1", "4.4.4.4"}, false, []net.IP{net.ParseIP("1.1.1.1").To4(), net.ParseIP("4.4.4.4").To4()}, branchFallback},
+	}
+	for _, tt := range tests {
+		s, err := NewServer(NewClient(WithTimeout(time.Second)),
+			WithCHNList(chnList),
+			WithIPBlacklist(blacklist),
+			WithStripBlacklisted(tt.strip),
+			WithResolvers(false, startUpstream(t, answerHandler(tt.answers...))),
+			WithDelay(time.Second),
+			WithSkipRefineResolvers(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		trace := new(queryTrace)
+		reply := s.resolve(req, logrus.NewEntry(logrus.StandardLogger()), trace)
+		if reply == nil {
+			t.Fatalf("%v should be resolved", tt.answers)
+		}
+		if ips := answerIPs(reply); !reflect.DeepEqual(ips, tt.want) || trace.Branch != tt.branch {
+			t.Errorf("%v with strip %v should be resolved as %v by %s, got %v by %s",
+				tt.answers, tt.strip, tt.want, tt.branch, ips, trace.Branch)
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/miekg/dns"
 
 	"github.com/cherrot/gochinadns/doh"
+	"github.com/cherrot/gochinadns/doq"
+	"github.com/cherrot/gochinadns/dot"
 )
 
 type Client struct {
@@ -13,6 +15,8 @@ type Client struct {
 	UDPCli *dns.Client
 	TCPCli *dns.Client
 	DoHCli *doh.Client
+	DoTCli *dot.Client
+	DoQCli *doq.Client
 }
 
 func NewClient(opts ...ClientOption) *Client {
@@ -27,7 +31,10 @@ func NewClient(opts ...ClientOption) *Client {
 		DoHCli: doh.NewClient(
 			doh.WithTimeout(o.Timeout),
 			doh.WithSkipQueryMySelf(o.DoHSkipQuerySelf),
+			doh.WithMethod(o.DoHMethod),
 		),
+		DoTCli: dot.NewClient(dot.WithTimeout(o.Timeout)),
+		DoQCli: doq.NewClient(doq.WithTimeout(o.Timeout)),
 	}
 }
 
@@ -37,6 +44,7 @@ type clientOptions struct {
 	TCPOnly          bool          // Use TCP only
 	Mutation         bool          // Enable DNS pointer mutation for trusted servers
 	DoHSkipQuerySelf bool
+	DoHMethod        string // HTTP method of DoH requests, GET or POST
 }
 
 type ClientOption func(*clientOptions)
@@ -70,3 +78,10 @@ func WithDoHSkipQuerySelf(skip bool) ClientOption {
 		o.DoHSkipQuerySelf = skip
 	}
 }
+
+// WithDoHMethod sets the HTTP method of DoH requests, GET or POST. Defaults to GET.
+func WithDoHMethod(method string) ClientOption {
+	return func(o *clientOptions) {
+		o.DoHMethod = method
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"github.com/cherrot/gochinadns"
+)
+
+// config is the configuration file of chinadns, in YAML or TOML format.
+// Flags set on the command line override values in the file.
+type config struct {
+	Verbose       bool             `yaml:"verbose" toml:"verbose"`
+	Listen        string           `yaml:"listen" toml:"listen"`
+	ReusePort     bool             `yaml:"reuse_port" toml:"reuse_port"`
+	UDPMaxBytes   int              `yaml:"udp_max_bytes" toml:"udp_max_bytes"`
+	ForceTCP      bool             `yaml:"force_tcp" toml:"force_tcp"`
+	Mutation      bool             `yaml:"mutation" toml:"mutation"`
+	Bidirectional bool             `yaml:"bidirectional" toml:"bidirectional"`
+	Classify      string           `yaml:"classify_policy" toml:"classify_policy"`
+	StripIPs      bool             `yaml:"strip_blacklisted" toml:"strip_blacklisted"`
+	Timeout       duration         `yaml:"timeout" toml:"timeout"`
+	Delay         duration         `yaml:"delay" toml:"delay"`
+	DoHMethod     string           `yaml:"doh_method" toml:"doh_method"`
+	TestDomains   []string         `yaml:"test_domains" toml:"test_domains"`
+	SkipRefine    bool             `yaml:"skip_refine" toml:"skip_refine"`
+	RefineTimeout duration         `yaml:"refine_timeout" toml:"refine_timeout"`
+	HealthCheck   duration         `yaml:"health_check" toml:"health_check"` // interval of health checks
+	NoScoring     bool             `yaml:"disable_scoring" toml:"disable_scoring"`
+	Shutdown      duration         `yaml:"shutdown_timeout" toml:"shutdown_timeout"` // max time to drain in-flight queries
+	MetricsListen string           `yaml:"metrics_listen" toml:"metrics_listen"`
+	Resolvers     []resolverConfig `yaml:"resolvers" toml:"resolvers"`
+	Groups        groupsConfig     `yaml:"resolver_groups" toml:"resolver_groups"`
+	Lists         listConfig       `yaml:"lists" toml:"lists"`
+	Cache         cacheConfig      `yaml:"cache" toml:"cache"`
+	QueryLog      queryLogConfig   `yaml:"query_log" toml:"query_log"`
+	Block         blockConfig      `yaml:"block" toml:"block"`
+}
+
+// resolverConfig describes an upstream resolver. Addr can be a full resolver schema like `udp+tcp@114.114.114.114`,
+// in which case the other fields except Trusted are optional.
+type resolverConfig struct {
+	Addr       string   `yaml:"addr" toml:"addr"`
+	Protocols  []string `yaml:"protocols" toml:"protocols"`
+	ServerName string   `yaml:"server_name" toml:"server_name"` // for dot and doq
+	Bootstrap  []string `yaml:"bootstrap" toml:"bootstrap"`     // for doh
+	Trusted    bool     `yaml:"trusted" toml:"trusted"`         // trust it even if it's located in China
+}
+
+// groupsConfig maps names of resolver groups to resolvers in schema format, which domains can be routed to.
+type groupsConfig map[string][]string
+
+type listConfig struct {
+	China           string `yaml:"china" toml:"china"`
+	IPBlacklist     string `yaml:"ip_blacklist" toml:"ip_blacklist"`
+	DomainBlacklist string `yaml:"domain_blacklist" toml:"domain_blacklist"`
+	DomainPolluted  string `yaml:"domain_polluted" toml:"domain_polluted"`
+	DomainChina     string `yaml:"domain_china" toml:"domain_china"`
+	DomainRoutes    string `yaml:"domain_routes" toml:"domain_routes"`
+	Watch           bool   `yaml:"watch" toml:"watch"` // reload lists when they are changed
+}
+
+type cacheConfig struct {
+	Disabled       bool     `yaml:"disabled" toml:"disabled"`
+	Entries        int      `yaml:"entries" toml:"entries"`
+	TTL            duration `yaml:"ttl" toml:"ttl"`
+	LazyExpire     bool     `yaml:"lazy_expire" toml:"lazy_expire"`
+	NegativeMaxTTL duration `yaml:"negative_max_ttl" toml:"negative_max_ttl"`
+	PrefetchHits   int      `yaml:"prefetch_hits" toml:"prefetch_hits"`
+	PrefetchWindow duration `yaml:"prefetch_window" toml:"prefetch_window"`
+}
+
+type queryLogConfig struct {
+	Path       string `yaml:"path" toml:"path"`
+	MaxSize    int    `yaml:"max_size" toml:"max_size"` // in megabytes
+	MaxBackups int    `yaml:"max_backups" toml:"max_backups"`
+	MaxAge     int    `yaml:"max_age" toml:"max_age"` // in days
+}
+
+// blockConfig describes how to reply queries hitting domain blacklist.
+type blockConfig struct {
+	Mode string   `yaml:"mode" toml:"mode"`
+	TTL  duration `yaml:"ttl" toml:"ttl"`
+}
+
+// duration is a time.Duration which can be decoded from strings like "1.5s".
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	t, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = duration(t)
+	return nil
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// String returns the resolver in schema format accepted by gochinadns.ParseResolver.
+func (r resolverConfig) String() string {
+	sb := new(strings.Builder)
+	if len(r.Protocols) > 0 {
+		sb.WriteString(strings.Join(r.Protocols, "+"))
+		sb.WriteByte('@')
+	}
+	sb.WriteString(r.Addr)
+	if r.ServerName != "" {
+		sb.WriteByte('#')
+		sb.WriteString(r.ServerName)
+	} else if len(r.Bootstrap) > 0 {
+		sb.WriteByte('#')
+		sb.WriteString(strings.Join(r.Bootstrap, ","))
+	}
+	return sb.String()
+}
+
+// configFromFlags generates a config from flag values, which are defaults if not set on the command line.
+func configFromFlags() *config {
+	cfg := &config{
+		Verbose:       *flagVerbose,
+		Listen:        net.JoinHostPort(*flagBind, strconv.Itoa(*flagPort)),
+		ReusePort:     *flagReusePort,
+		UDPMaxBytes:   *flagUDPMaxBytes,
+		ForceTCP:      *flagForceTCP,
+		Mutation:      *flagMutation,
+		Bidirectional: *flagBidirectional,
+		Classify:      *flagClassify,
+		StripIPs:      *flagStripBlacklist,
+		Timeout:       duration(*flagTimeout),
+		Delay:         duration(*flagDelay * float64(time.Second)),
+		DoHMethod:     *flagDoHMethod,
+		SkipRefine:    *flagSkipRefine,
+		RefineTimeout: duration(*flagRefineTimeout),
+		HealthCheck:   duration(*flagHealthCheck),
+		NoScoring:     *flagDisableScoring,
+		Shutdown:      duration(*flagShutdownTimeout),
+		MetricsListen: *flagMetricsListen,
+		Lists: listConfig{
+			China:           *flagCHNList,
+			IPBlacklist:     *flagIPBlacklist,
+			DomainBlacklist: *flagDomainBlacklist,
+			DomainPolluted:  *flagDomainPolluted,
+			DomainChina:     *flagDomainChina,
+			DomainRoutes:    *flagDomainRoutes,
+			Watch:           *flagWatchLists,
+		},
+		Cache: cacheConfig{
+			Disabled:       *flagDisableCache,
+			Entries:        *flagCacheEntries,
+			TTL:            duration(*flagCacheTTL),
+			LazyExpire:     *flagLazyExpire,
+			NegativeMaxTTL: duration(*flagNegativeTTL),
+			PrefetchHits:   *flagPrefetchHits,
+			PrefetchWindow: duration(*flagPrefetchWindow),
+		},
+		Block: blockConfig{
+			Mode: *flagBlockMode,
+			TTL:  duration(*flagBlockTTL),
+		},
+		QueryLog: queryLogConfig{
+			Path:       *flagQueryLog,
+			MaxSize:    *flagQueryLogSize,
+			MaxBackups: *flagQueryLogBackups,
+			MaxAge:     *flagQueryLogAge,
+		},
+	}
+	if *flagTestDomains != "" {
+		cfg.TestDomains = strings.Split(*flagTestDomains, ",")
+	}
+	for _, addr := range flagResolvers {
+		cfg.Resolvers = append(cfg.Resolvers, resolverConfig{Addr: addr})
+	}
+	for _, addr := range flagTrustedResolvers {
+		cfg.Resolvers = append(cfg.Resolvers, resolverConfig{Addr: addr, Trusted: true})
+	}
+	for name, addrs := range flagResolverGroups {
+		if cfg.Groups == nil {
+			cfg.Groups = make(groupsConfig)
+		}
+		cfg.Groups[name] = addrs
+	}
+	return cfg
+}
+
+// loadConfig loads config from the file specified by -config, and overrides it by flags set on the command line.
+// If no config file is specified, config is generated from flags.
+func loadConfig(path string) (*config, error) {
+	if path == "" {
+		return configFromFlags(), nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read config file: %w", err)
+	}
+
+	cfg := configFromFlags()
+	// Lists are decoded from scratch, since TOML decoder fills existing elements rather than replacing them.
+	resolvers, groups := cfg.Resolvers, cfg.Groups
+	cfg.Resolvers, cfg.Groups = nil, nil
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, cfg)
+	case ".toml":
+		err = toml.Unmarshal(content, cfg)
+	default:
+		return nil, fmt.Errorf("unsupported config file format %q, should be .yaml, .yml or .toml", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fail to parse config file %s: %w", path, err)
+	}
+	if cfg.Resolvers == nil {
+		cfg.Resolvers = resolvers
+	}
+	if cfg.Groups == nil {
+		cfg.Groups = groups
+	}
+
+	flags := configFromFlags()
+	flag.Visit(func(f *flag.Flag) {
+		cfg.override(flags, f.Name)
+	})
+	return cfg, nil
+}
+
+// override overrides the config item corresponding to flag name with the value in flags.
+func (cfg *config) override(flags *config, name string) {
+	switch name {
+	case "v":
+		cfg.Verbose = flags.Verbose
+	case "b", "p":
+		host, port, err := net.SplitHostPort(cfg.Listen)
+		if err != nil {
+			cfg.Listen = flags.Listen
+			return
+		}
+		if name == "b" {
+			host = *flagBind
+		} else {
+			port = strconv.Itoa(*flagPort)
+		}
+		cfg.Listen = net.JoinHostPort(host, port)
+	case "reuse-port":
+		cfg.ReusePort = flags.ReusePort
+	case "udp-max-bytes":
+		cfg.UDPMaxBytes = flags.UDPMaxBytes
+	case "force-tcp":
+		cfg.ForceTCP = flags.ForceTCP
+	case "m":
+		cfg.Mutation = flags.Mutation
+	case "d":
+		cfg.Bidirectional = flags.Bidirectional
+	case "classify-policy":
+		cfg.Classify = flags.Classify
+	case "strip-blacklisted":
+		cfg.StripIPs = flags.StripIPs
+	case "timeout":
+		cfg.Timeout = flags.Timeout
+	case "y":
+		cfg.Delay = flags.Delay
+	case "doh-method":
+		cfg.DoHMethod = flags.DoHMethod
+	case "test-domains":
+		cfg.TestDomains = flags.TestDomains
+	case "skip-refine":
+		cfg.SkipRefine = flags.SkipRefine
+	case "refine-timeout":
+		cfg.RefineTimeout = flags.RefineTimeout
+	case "health-check":
+		cfg.HealthCheck = flags.HealthCheck
+	case "disable-scoring":
+		cfg.NoScoring = flags.NoScoring
+	case "shutdown-timeout":
+		cfg.Shutdown = flags.Shutdown
+	case "metrics-listen":
+		cfg.MetricsListen = flags.MetricsListen
+	case "s", "trusted-servers":
+		trusted := name == "trusted-servers"
+		var resolvers []resolverConfig
+		for _, r := range cfg.Resolvers {
+			if r.Trusted != trusted {
+				resolvers = append(resolvers, r)
+			}
+		}
+		for _, r := range flags.Resolvers {
+			if r.Trusted == trusted {
+				resolvers = append(resolvers, r)
+			}
+		}
+		cfg.Resolvers = resolvers
+	case "c":
+		cfg.Lists.China = flags.Lists.China
+	case "l":
+		cfg.Lists.IPBlacklist = flags.Lists.IPBlacklist
+	case "domain-blacklist":
+		cfg.Lists.DomainBlacklist = flags.Lists.DomainBlacklist
+	case "domain-polluted":
+		cfg.Lists.DomainPolluted = flags.Lists.DomainPolluted
+	case "domain-china":
+		cfg.Lists.DomainChina = flags.Lists.DomainChina
+	case "domain-routes":
+		cfg.Lists.DomainRoutes = flags.Lists.DomainRoutes
+	case "resolver-group":
+		cfg.Groups = flags.Groups
+	case "watch-lists":
+		cfg.Lists.Watch = flags.Lists.Watch
+	case "disable-cache":
+		cfg.Cache.Disabled = flags.Cache.Disabled
+	case "cache-entries":
+		cfg.Cache.Entries = flags.Cache.Entries
+	case "cache-ttl":
+		cfg.Cache.TTL = flags.Cache.TTL
+	case "lazy-expire":
+		cfg.Cache.LazyExpire = flags.Cache.LazyExpire
+	case "negative-cache-max-ttl":
+		cfg.Cache.NegativeMaxTTL = flags.Cache.NegativeMaxTTL
+	case "prefetch-hits":
+		cfg.Cache.PrefetchHits = flags.Cache.PrefetchHits
+	case "prefetch-window":
+		cfg.Cache.PrefetchWindow = flags.Cache.PrefetchWindow
+	case "block-mode":
+		cfg.Block.Mode = flags.Block.Mode
+	case "block-ttl":
+		cfg.Block.TTL = flags.Block.TTL
+	case "query-log":
+		cfg.QueryLog.Path = flags.QueryLog.Path
+	case "query-log-max-size":
+		cfg.QueryLog.MaxSize = flags.QueryLog.MaxSize
+	case "query-log-max-backups":
+		cfg.QueryLog.MaxBackups = flags.QueryLog.MaxBackups
+	case "query-log-max-age":
+		cfg.QueryLog.MaxAge = flags.QueryLog.MaxAge
+	}
+}
+
+// ServerOptions converts config to gochinadns.ServerOption list.
+func (cfg *config) ServerOptions() []gochinadns.ServerOption {
+	var resolvers, trusted []string
+	for _, r := range cfg.Resolvers {
+		if r.Trusted {
+			trusted = append(trusted, r.String())
+		} else {
+			resolvers = append(resolvers, r.String())
+		}
+	}
+
+	opts := []gochinadns.ServerOption{
+		gochinadns.WithListenAddr(cfg.Listen),
+		gochinadns.WithBidirectional(cfg.Bidirectional),
+		gochinadns.WithClassifyPolicy(cfg.Classify),
+		gochinadns.WithStripBlacklisted(cfg.StripIPs),
+		gochinadns.WithReusePort(cfg.ReusePort),
+		gochinadns.WithDelay(time.Duration(cfg.Delay)),
+		gochinadns.WithTrustedResolvers(cfg.ForceTCP, trusted...),
+		gochinadns.WithResolvers(cfg.ForceTCP, resolvers...),
+		gochinadns.WithSkipRefineResolvers(cfg.SkipRefine),
+		gochinadns.WithRefineTimeout(time.Duration(cfg.RefineTimeout)),
+		gochinadns.WithHealthCheck(time.Duration(cfg.HealthCheck)),
+		gochinadns.WithDisableScoring(cfg.NoScoring),
+		gochinadns.WithShutdownTimeout(time.Duration(cfg.Shutdown)),
+		gochinadns.WithDisableCache(cfg.Cache.Disabled),
+		gochinadns.WithCacheEntries(cfg.Cache.Entries),
+		gochinadns.WithCacheTTL(time.Duration(cfg.Cache.TTL)),
+		gochinadns.WithLazyExpire(cfg.Cache.LazyExpire),
+		gochinadns.WithNegativeCacheMaxTTL(time.Duration(cfg.Cache.NegativeMaxTTL)),
+		gochinadns.WithPrefetch(cfg.Cache.PrefetchHits, time.Duration(cfg.Cache.PrefetchWindow)),
+		gochinadns.WithMetricsListenAddr(cfg.MetricsListen),
+		gochinadns.WithBlockMode(cfg.Block.Mode),
+		gochinadns.WithBlockTTL(time.Duration(cfg.Block.TTL)),
+		gochinadns.WithQueryLog(cfg.QueryLog.Path),
+		gochinadns.WithQueryLogRotation(cfg.QueryLog.MaxSize, cfg.QueryLog.MaxBackups, cfg.QueryLog.MaxAge),
+	}
+	if len(cfg.TestDomains) > 0 {
+		opts = append(opts, gochinadns.WithTestDomains(cfg.TestDomains...))
+	}
+	if cfg.Lists.China != "" {
+		opts = append(opts, gochinadns.WithCHNList(cfg.Lists.China))
+	}
+	if cfg.Lists.IPBlacklist != "" {
+		opts = append(opts, gochinadns.WithIPBlacklist(cfg.Lists.IPBlacklist))
+	}
+	if cfg.Lists.DomainBlacklist != "" {
+		opts = append(opts, gochinadns.WithDomainBlacklist(cfg.Lists.DomainBlacklist))
+	}
+	if cfg.Lists.DomainPolluted != "" {
+		opts = append(opts, gochinadns.WithDomainPolluted(cfg.Lists.DomainPolluted))
+	}
+	if cfg.Lists.DomainChina != "" {
+		opts = append(opts, gochinadns.WithDomainChina(cfg.Lists.DomainChina))
+	}
+	for name, addrs := range cfg.Groups {
+		opts = append(opts, gochinadns.WithResolverGroup(name, cfg.ForceTCP, addrs...))
+	}
+	if cfg.Lists.DomainRoutes != "" {
+		opts = append(opts, gochinadns.WithDomainRoutes(cfg.Lists.DomainRoutes))
+	}
+	return opts
+}
+
+// ClientOptions converts config to gochinadns.ClientOption list.
+func (cfg *config) ClientOptions() []gochinadns.ClientOption {
+	return []gochinadns.ClientOption{
+		gochinadns.WithUDPMaxBytes(cfg.UDPMaxBytes),
+		gochinadns.WithTCPOnly(cfg.ForceTCP),
+		gochinadns.WithMutation(cfg.Mutation),
+		gochinadns.WithTimeout(time.Duration(cfg.Timeout)),
+		gochinadns.WithDoHSkipQuerySelf(true),
+		gochinadns.WithDoHMethod(cfg.DoHMethod),
+	}
+}
+
+// Validate checks config items which can not be checked by gochinadns options.
+func (cfg *config) Validate() error {
+	if m := strings.ToUpper(cfg.DoHMethod); m != "" && m != http.MethodGet && m != http.MethodPost {
+		return fmt.Errorf("unsupported DoH method %s, should be GET or POST", cfg.DoHMethod)
+	}
+	if _, _, err := net.SplitHostPort(cfg.Listen); err != nil {
+		return fmt.Errorf("invalid listen address %s: %w", cfg.Listen, err)
+	}
+	if cfg.Delay <= 0 {
+		return fmt.Errorf("delay should be positive, got %s", time.Duration(cfg.Delay))
+	}
+	for _, r := range cfg.Resolvers {
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate checks if fields of the resolver conflict with each other or with the schema in Addr.
+func (r resolverConfig) validate() error {
+	if r.ServerName != "" && len(r.Bootstrap) > 0 {
+		return fmt.Errorf("resolver %s: server_name and bootstrap can not be set at the same time", r.Addr)
+	}
+	if proto, _, ok := strings.Cut(r.Addr, "@"); ok && !strings.Contains(proto, "/") && len(r.Protocols) > 0 {
+		return fmt.Errorf("resolver %s: protocols can not be set if addr already has them", r.Addr)
+	}
+	if strings.Contains(r.Addr, "#") && (r.ServerName != "" || len(r.Bootstrap) > 0) {
+		return fmt.Errorf("resolver %s: server_name and bootstrap can not be set if addr already has them", r.Addr)
+	}
+	return nil
+}
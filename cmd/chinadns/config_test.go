@@ -0,0 +1,302 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// setFlags parses args as if they were set on the command line, and restores flags when the test finishes.
+func setFlags(t *testing.T, args ...string) {
+	resolvers, trusted := flagResolvers, flagTrustedResolvers
+	fs := flag.NewFlagSet("chinadns", flag.ContinueOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	commandLine := flag.CommandLine
+	flag.CommandLine = fs
+	t.Cleanup(func() {
+		flag.CommandLine = commandLine
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "s", "trusted-servers", "resolver-group":
+			default:
+				_ = f.Value.Set(f.DefValue)
+			}
+		})
+		flagResolvers, flagTrustedResolvers = resolvers, trusted
+		clear(flagResolverGroups)
+	})
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const yamlConfig = `
+listen: "127.0.0.1:5353"
+timeout: 1.5s
+delay: 50ms
+resolvers:
+  - addr: 114.114.114.114
+    protocols: [udp, tcp]
+  - addr: 1.1.1.1
+    protocols: [dot]
+    server_name: cloudflare-dns.com
+    trusted: true
+resolver_groups:
+  corp: [10.0.0.53]
+lists:
+  china: ./china.list
+  watch: true
+cache:
+  entries: 100
+  negative_max_ttl: 1h
+`
+
+const tomlConfig = `
+listen = "127.0.0.1:5353"
+timeout = "1.5s"
+delay = "50ms"
+
+[[resolvers]]
+addr = "114.114.114.114"
+protocols = ["udp", "tcp"]
+
+[[resolvers]]
+addr = "1.1.1.1"
+protocols = ["dot"]
+server_name = "cloudflare-dns.com"
+trusted = true
+
+[resolver_groups]
+corp = ["10.0.0.53"]
+
+[lists]
+china = "./china.list"
+watch = true
+
+[cache]
+entries = 100
+negative_max_ttl = "1h"
+`
+
+func TestLoadConfig(t *testing.T) {
+	want := []resolverConfig{
+		{Addr: "114.114.114.114", Protocols: []string{"udp", "tcp"}},
+		{Addr: "1.1.1.1", Protocols: []string{"dot"}, ServerName: "cloudflare-dns.com", Trusted: true},
+	}
+	for name, content := range map[string]string{"chinadns.yaml": yamlConfig, "chinadns.toml": tomlConfig} {
+		cfg, err := loadConfig(writeConfig(t, name, content))
+		if err != nil {
+			t.Fatalf("Fail to load %s: %v", name, err)
+		}
+		if cfg.Listen != "127.0.0.1:5353" || cfg.Timeout != duration(1500*time.Millisecond) ||
+			cfg.Delay != duration(50*time.Millisecond) {
+			t.Errorf("%s: unexpected listen, timeout or delay: %s, %s, %s",
+				name, cfg.Listen, time.Duration(cfg.Timeout), time.Duration(cfg.Delay))
+		}
+		if !reflect.DeepEqual(cfg.Resolvers, want) {
+			t.Errorf("%s: resolvers should be %v, got %v", name, want, cfg.Resolvers)
+		}
+		if !reflect.DeepEqual(cfg.Groups, groupsConfig{"corp": {"10.0.0.53"}}) {
+			t.Errorf("%s: unexpected resolver groups %v", name, cfg.Groups)
+		}
+		if !cfg.Lists.Watch || cfg.Cache.Entries != 100 || cfg.Cache.NegativeMaxTTL != duration(time.Hour) {
+			t.Errorf("%s: unexpected lists or cache: %+v, %+v", name, cfg.Lists, cfg.Cache)
+		}
+		// items not in the file keep defaults of flags.
+		if cfg.UDPMaxBytes != 4096 || !cfg.Bidirectional || cfg.Cache.PrefetchWindow != duration(10*time.Second) {
+			t.Errorf("%s: items not in the file should be defaults", name)
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("%s: config should be valid, got %v", name, err)
+		}
+	}
+
+	if _, err := loadConfig(writeConfig(t, "chinadns.json", "{}")); err == nil {
+		t.Error("Unsupported config format should fail to load")
+	}
+	if _, err := loadConfig(writeConfig(t, "chinadns.yaml", "timeout: 2 seconds\n")); err == nil {
+		t.Error("Invalid duration should fail to load")
+	}
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("Missing config file should fail to load")
+	}
+}
+
+func TestLoadConfigOverride(t *testing.T) {
+	path := writeConfig(t, "chinadns.yaml", yamlConfig)
+
+	t.Run("port", func(t *testing.T) {
+		setFlags(t, "-p", "53", "-timeout", "3s", "-y", "0.2")
+		cfg, err := loadConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Listen != "127.0.0.1:53" {
+			t.Errorf("Port should be overridden with host kept, got %s", cfg.Listen)
+		}
+		if cfg.Timeout != duration(3*time.Second) || cfg.Delay != duration(200*time.Millisecond) {
+			t.Errorf("Timeout and delay should be overridden, got %s, %s", time.Duration(cfg.Timeout), time.Duration(cfg.Delay))
+		}
+		if cfg.Cache.Entries != 100 {
+			t.Error("Items without flags set should not be overridden")
+		}
+	})
+
+	t.Run("bind", func(t *testing.T) {
+		setFlags(t, "-b", "::1")
+		cfg, err := loadConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Listen != "[::1]:5353" {
+			t.Errorf("Bind address should be overridden with port kept, got %s", cfg.Listen)
+		}
+	})
+
+	t.Run("trusted servers", func(t *testing.T) {
+		setFlags(t, "-trusted-servers", "8.8.8.8,dot@9.9.9.9")
+		cfg, err := loadConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []resolverConfig{
+			{Addr: "114.114.114.114", Protocols: []string{"udp", "tcp"}},
+			{Addr: "8.8.8.8", Trusted: true},
+			{Addr: "dot@9.9.9.9", Trusted: true},
+		}
+		if !reflect.DeepEqual(cfg.Resolvers, want) {
+			t.Errorf("Only trusted resolvers should be replaced, want %v, got %v", want, cfg.Resolvers)
+		}
+	})
+
+	t.Run("servers", func(t *testing.T) {
+		setFlags(t, "-s", "223.5.5.5", "-resolver-group", "lab=10.1.0.53")
+		cfg, err := loadConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []resolverConfig{
+			{Addr: "1.1.1.1", Protocols: []string{"dot"}, ServerName: "cloudflare-dns.com", Trusted: true},
+			{Addr: "223.5.5.5"},
+		}
+		if !reflect.DeepEqual(cfg.Resolvers, want) {
+			t.Errorf("Only untrusted resolvers should be replaced, want %v, got %v", want, cfg.Resolvers)
+		}
+		if !reflect.DeepEqual(cfg.Groups, groupsConfig{"lab": {"10.1.0.53"}}) {
+			t.Errorf("Resolver groups should be replaced, got %v", cfg.Groups)
+		}
+	})
+
+	t.Run("toml", func(t *testing.T) {
+		setFlags(t, "-trusted-servers", "9.9.9.9")
+		path := writeConfig(t, "chinadns.toml", `
+[[resolvers]]
+addr = "1.1.1.1"
+[[resolvers]]
+addr = "2.2.2.2"
+[[resolvers]]
+addr = "3.3.3.3"
+`)
+		cfg, err := loadConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []resolverConfig{{Addr: "1.1.1.1"}, {Addr: "2.2.2.2"}, {Addr: "3.3.3.3"}, {Addr: "9.9.9.9", Trusted: true}}
+		if !reflect.DeepEqual(cfg.Resolvers, want) {
+			t.Errorf("Resolvers in TOML should not inherit fields from flags, want %v, got %v", want, cfg.Resolvers)
+		}
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		cfg, err := loadConfig(writeConfig(t, "chinadns.toml", "listen = \"127.0.0.1:53\"\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cfg.Resolvers, configFromFlags().Resolvers) {
+			t.Errorf("Resolvers not in the file should be defaults, got %v", cfg.Resolvers)
+		}
+	})
+
+	t.Run("no config file", func(t *testing.T) {
+		setFlags(t, "-b", "127.0.0.1", "-p", "5353")
+		cfg, err := loadConfig("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Listen != "127.0.0.1:5353" || len(cfg.Resolvers) != 2 {
+			t.Errorf("Config should be generated from flags, got %s, %v", cfg.Listen, cfg.Resolvers)
+		}
+	})
+}
+
+func TestResolverConfigString(t *testing.T) {
+	tests := []struct {
+		resolver resolverConfig
+		want     string
+	}{
+		{resolverConfig{Addr: "114.114.114.114"}, "114.114.114.114"},
+		{resolverConfig{Addr: "114.114.114.114:53", Protocols: []string{"udp", "tcp"}}, "udp+tcp@114.114.114.114:53"},
+		{resolverConfig{Addr: "1.1.1.1", Protocols: []string{"dot"}, ServerName: "cloudflare-dns.com"}, "dot@1.1.1.1#cloudflare-dns.com"},
+		{resolverConfig{Addr: "https://dns.google/dns-query", Protocols: []string{"doh"}, Bootstrap: []string{"8.8.8.8", "8.8.4.4"}},
+			"doh@https://dns.google/dns-query#8.8.8.8,8.8.4.4"},
+		{resolverConfig{Addr: "udp@127.0.0.1:5353", Trusted: true}, "udp@127.0.0.1:5353"},
+	}
+	for _, tt := range tests {
+		if got := tt.resolver.String(); got != tt.want {
+			t.Errorf("%+v should be %s, got %s", tt.resolver, tt.want, got)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := func() *config {
+		return &config{Listen: "127.0.0.1:53", Delay: duration(100 * time.Millisecond), DoHMethod: "post"}
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("Config should be valid, got %v", err)
+	}
+
+	invalid := map[string]func(cfg *config){
+		"DoH method": func(cfg *config) { cfg.DoHMethod = "PUT" },
+		"listen":     func(cfg *config) { cfg.Listen = "127.0.0.1" },
+		"delay":      func(cfg *config) { cfg.Delay = 0 },
+		"server name": func(cfg *config) {
+			cfg.Resolvers = []resolverConfig{{Addr: "1.1.1.1", ServerName: "one.one.one.one", Bootstrap: []string{"1.1.1.1"}}}
+		},
+		"protocols": func(cfg *config) {
+			cfg.Resolvers = []resolverConfig{{Addr: "udp@1.1.1.1", Protocols: []string{"tcp"}}}
+		},
+		"schema server name": func(cfg *config) {
+			cfg.Resolvers = []resolverConfig{{Addr: "dot@1.1.1.1#one.one.one.one", ServerName: "cloudflare-dns.com"}}
+		},
+	}
+	for name, f := range invalid {
+		cfg := valid()
+		f(cfg)
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Config with invalid %s should fail to validate", name)
+		}
+	}
+
+	cfg := valid()
+	cfg.Resolvers = []resolverConfig{
+		{Addr: "https://user@dns.example/dns-query", Protocols: []string{"doh"}},
+		{Addr: "dot@1.1.1.1", ServerName: "cloudflare-dns.com"},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Resolvers should be valid, got %v", err)
+	}
+}
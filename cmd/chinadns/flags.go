@@ -2,33 +2,66 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"net"
+	"sort"
 	"strings"
 	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 var (
 	flagVersion = flag.Bool("V", false, "Print version and exit.")
 	flagVerbose = flag.Bool("v", false, "Enable verbose logging.")
 
+	flagConfig      = flag.String("config", "", "Path to config file in YAML (.yaml, .yml) or TOML (.toml) format. Flags set on the command line override values in it.")
+	flagCheckConfig = flag.Bool("check-config", false, "Validate configuration and exit.")
+
 	flagBind            = flag.String("b", "::", "Bind address.")
 	flagPort            = flag.Int("p", 53, "Listening port.")
 	flagUDPMaxBytes     = flag.Int("udp-max-bytes", 4096, "Default DNS max message size on UDP.")
 	flagForceTCP        = flag.Bool("force-tcp", false, "Force DNS queries use TCP only. Only applies to resolvers declared in ip:port format.")
 	flagMutation        = flag.Bool("m", false, "Enable compression pointer mutation in DNS queries.")
 	flagBidirectional   = flag.Bool("d", true, "Drop results of trusted servers which containing IPs in China. (Bidirectional mode.)")
+	flagClassify        = flag.String("classify-policy", "all", "Policy to classify IPs in an answer as in China: all, any or majority of them are in China.")
+	flagStripBlacklist  = flag.Bool("strip-blacklisted", false, "Strip IPs hitting IP blacklist from answers, instead of dropping the whole answer.")
 	flagReusePort       = flag.Bool("reuse-port", true, "Enable SO_REUSEPORT to gain some performance optimization. Need Linux>=3.9")
 	flagTimeout         = flag.Duration("timeout", 2*time.Second, "DNS request timeout")
+	flagDoHMethod       = flag.String("doh-method", "GET", "HTTP method of DoH requests, GET or POST.")
 	flagDelay           = flag.Float64("y", 0.1, "Delay (in seconds) to query another DNS server when no reply received.")
 	flagTestDomains     = flag.String("test-domains", "www.qq.com", "Domain names to test DNS connection health, separated by comma.")
 	flagCHNList         = flag.String("c", "./china.list", "Path to China route list. Both IPv4 and IPv6 are supported. See http://ipverse.net")
 	flagIPBlacklist     = flag.String("l", "", "Path to IP blacklist file.")
-	flagDomainBlacklist = flag.String("domain-blacklist", "", "Path to domain blacklist file.")
-	flagDomainPolluted  = flag.String("domain-polluted", "", "Path to polluted domains list. Queries of these domains will not be sent to DNS in China.")
+	flagDomainBlacklist = flag.String("domain-blacklist", "", "Path to domain blacklist file. Format can be set by prefix like gfwlist:path, and is detected automatically by default.")
+	flagDomainPolluted  = flag.String("domain-polluted", "", "Path to polluted domains list. Queries of these domains will not be sent to DNS in China. Format can be set by prefix like gfwlist:path, and is detected automatically by default.")
+	flagBlockMode       = flag.String("block-mode", "empty", "How to reply queries hitting domain blacklist: empty, nxdomain, refused, nodata, null (0.0.0.0 and ::), or comma separated sinkhole IPs.")
+	flagBlockTTL        = flag.Duration("block-ttl", time.Minute, "TTL of answers and SOA records in replies to queries hitting domain blacklist.")
+	flagDomainChina     = flag.String("domain-china", "", "Path to China domains list. Queries of these domains will only be sent to DNS in China, unless they are also in polluted domains list. Format can be set by prefix like gfwlist:path, and is detected automatically by default.")
+	flagDomainRoutes    = flag.String("domain-routes", "", "Path to domain routes file. Each line is server=/domain[/domain...]/group or \"domain group\", "+
+		"where group is trusted, untrusted or a group set by -resolver-group. Queries of these domains are sent to the group only.")
+	flagWatchLists      = flag.Bool("watch-lists", false, "Reload China route list, IP blacklist and domain lists when they are changed. Lists are also reloaded on SIGHUP.")
 	flagSkipRefine      = flag.Bool("skip-refine", false, "If true, will keep the specified resolver order and skip the refine process.")
+	flagRefineTimeout   = flag.Duration("refine-timeout", 10*time.Second, "Time budget to test resolvers in the refine process before starting the server. Set to 0 for no limit.")
+	flagShutdownTimeout = flag.Duration("shutdown-timeout", 5*time.Second, "Max time to wait for in-flight queries when chinadns is stopped by SIGINT or SIGTERM.")
+	flagDisableScoring  = flag.Bool("disable-scoring", false, "Disable ordering resolvers by RTT and error rate learned from live traffic, and always try them in the refined or specified order.")
+	flagHealthCheck     = flag.Duration("health-check", 0, "Interval to check health of resolvers in background, re-rank them and eject the failing ones until they recover. Set to 0 to disable it.")
+	flagDisableCache    = flag.Bool("disable-cache", false, "Disable built-in DNS cache.")
+	flagCacheEntries    = flag.Int("cache-entries", 5000, "Max DNS cache entries.")
+	flagCacheTTL        = flag.Duration("cache-ttl", 0, "Cache TTL. Set to 0 to use TTL in DNS answers.")
+	flagLazyExpire      = flag.Bool("lazy-expire", true, "In lazy mode, cache could still be used when DNS timeout happens, even if it was expired.")
+	flagNegativeTTL     = flag.Duration("negative-cache-max-ttl", time.Hour, "Max TTL of cached NXDOMAIN and NODATA answers. Set to 0 to disable negative caching.")
+	flagPrefetchHits    = flag.Int("prefetch-hits", 0, "Refresh a cache entry in background when it has been hit this many times and is about to expire. Set to 0 to disable prefetch.")
+	flagPrefetchWindow  = flag.Duration("prefetch-window", 10*time.Second, "Prefetch a popular cache entry when its remaining TTL is less than this window.")
+	flagMetricsListen   = flag.String("metrics-listen", "", "Listening address of Prometheus metrics endpoint /metrics, such as 127.0.0.1:9153. Metrics are disabled if empty.")
+	flagQueryLog        = flag.String("query-log", "", "Path to query log file, which records every query and how it is answered in JSON lines. Query log is disabled if empty.")
+	flagQueryLogSize    = flag.Int("query-log-max-size", 100, "Max size in megabytes of query log file before it gets rotated.")
+	flagQueryLogBackups = flag.Int("query-log-max-backups", 3, "Max number of rotated query log files to retain. Set to 0 to retain all.")
+	flagQueryLogAge     = flag.Int("query-log-max-age", 0, "Max days to retain rotated query log files. Set to 0 to retain all.")
 
 	flagResolvers        resolverAddrs = []string{"udp+tcp@119.29.29.29:53", "udp+tcp@114.114.114.114:53"}
 	flagTrustedResolvers resolverAddrs = []string{}
+	flagResolverGroups                 = resolverGroups{}
 )
 
 func init() {
@@ -37,9 +70,13 @@ func init() {
 		"Protocols are dialed in order left to right. Rightmost protocol will only be dialed if the leftmost fails.\n"+
 		"Protocols will override force-tcp flag. "+
 		"If empty, protocol defaults to udp+tcp (tcp if force-tcp is set) and port defaults to 53.\n"+
-		"Examples: 8.8.8.8,udp@127.0.0.1:5353,udp+tcp@1.1.1.1, doh@https://cloudflare-dns.com/dns-query")
+		"DoT and DoQ servers can be in format dot@ip[:port][#servername] or doq@ip[:port][#servername], where servername is used to verify the server certificate.\n"+
+		"DoH servers can carry bootstrap IPs in format doh@url#ip[,ip], IPs following # are always treated as bootstrap IPs.\n"+
+		"Examples: 8.8.8.8,udp@127.0.0.1:5353,udp+tcp@1.1.1.1, doh@https://cloudflare-dns.com/dns-query, dot@1.1.1.1#cloudflare-dns.com, doq@94.140.14.140#dns-unfiltered.adguard.com, doh@https://dns.google/dns-query#8.8.8.8,8.8.4.4")
 	flag.Var(&flagTrustedResolvers, "trusted-servers", "Comma separated list of servers which (located in China but) can be trusted. \n"+
 		"Uses the same format as -s.")
+	flag.Var(flagResolverGroups, "resolver-group", "Named group of servers which domains can be routed to by -domain-routes, in format name=server[,server...]. \n"+
+		"Servers use the same format as -s. Can be set multiple times for different groups.")
 }
 
 type resolverAddrs []string
@@ -64,7 +101,54 @@ func (rs *resolverAddrs) String() string {
 }
 
 func (rs *resolverAddrs) Set(s string) error {
-	addrs := strings.Split(s, ",")
+	var addrs []string
+	for _, addr := range strings.Split(s, ",") {
+		// Bare IPs following a DoH resolver with "#" are its bootstrap IPs,
+		// e.g. doh@https://dns.google/dns-query#8.8.8.8,8.8.4.4
+		last := len(addrs) - 1
+		if last >= 0 && strings.HasPrefix(addrs[last], "doh@") && strings.Contains(addrs[last], "#") &&
+			net.ParseIP(strings.Trim(strings.TrimSpace(addr), "[]")) != nil {
+			logrus.Warnf("%s is treated as a bootstrap IP of %s. Write it like udp+tcp@%s if it's a resolver.",
+				addr, addrs[last], addr)
+			addrs[last] += "," + addr
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
 	*rs = addrs
 	return nil
 }
+
+type resolverGroups map[string]resolverAddrs
+
+func (gs resolverGroups) String() string {
+	names := make([]string, 0, len(gs))
+	for name := range gs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sb := new(strings.Builder)
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		addrs := gs[name]
+		sb.WriteString(name)
+		sb.WriteByte('=')
+		sb.WriteString(addrs.String())
+	}
+	return sb.String()
+}
+
+func (gs resolverGroups) Set(s string) error {
+	name, addrs, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("invalid resolver group %q, should be in format name=server[,server...]", s)
+	}
+	var rs resolverAddrs
+	if err := rs.Set(addrs); err != nil {
+		return err
+	}
+	gs[name] = rs
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestResolverAddrsSet(t *testing.T) {
+	hook := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	tests := []struct {
+		value    string
+		want     resolverAddrs
+		warnings int
+	}{
+		{"8.8.8.8,udp@1.1.1.1", resolverAddrs{"8.8.8.8", "udp@1.1.1.1"}, 0},
+		{"doh@https://dns.google/dns-query#8.8.8.8,8.8.4.4", resolverAddrs{"doh@https://dns.google/dns-query#8.8.8.8,8.8.4.4"}, 1},
+		{"doh@https://dns.google/dns-query#8.8.8.8,udp+tcp@114.114.114.114",
+			resolverAddrs{"doh@https://dns.google/dns-query#8.8.8.8", "udp+tcp@114.114.114.114"}, 0},
+		{"doh@https://dns.google/dns-query,114.114.114.114", resolverAddrs{"doh@https://dns.google/dns-query", "114.114.114.114"}, 0},
+	}
+	for _, tt := range tests {
+		hook.Reset()
+		var rs resolverAddrs
+		if err := rs.Set(tt.value); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(rs, tt.want) {
+			t.Errorf("%s should be parsed as %v, got %v", tt.value, tt.want, rs)
+		}
+		if n := len(hook.AllEntries()); n != tt.warnings {
+			t.Errorf("%s should log %d warnings of bootstrap IPs, got %d", tt.value, tt.warnings, n)
+		}
+	}
+}
@@ -4,12 +4,13 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"net"
+	"os"
+	"os/signal"
 	"reflect"
 	"runtime"
 	"runtime/debug"
-	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -24,54 +25,69 @@ func main() {
 		fmt.Printf("Go version: %s\n", runtime.Version())
 		return
 	}
-	if *flagVerbose {
-		logrus.SetLevel(logrus.DebugLevel)
-	}
-
-	listen := net.JoinHostPort(*flagBind, strconv.Itoa(*flagPort))
-	opts := []gochinadns.ServerOption{
-		gochinadns.WithListenAddr(listen),
-		gochinadns.WithBidirectional(*flagBidirectional),
-		gochinadns.WithReusePort(*flagReusePort),
-		gochinadns.WithDelay(time.Duration(*flagDelay * float64(time.Second))),
-		gochinadns.WithTrustedResolvers(*flagForceTCP, flagTrustedResolvers...),
-		gochinadns.WithResolvers(*flagForceTCP, flagResolvers...),
-		gochinadns.WithSkipRefineResolvers(*flagSkipRefine),
+	cfg, err := loadConfig(*flagConfig)
+	if err == nil {
+		err = cfg.Validate()
 	}
-	if *flagTestDomains != "" {
-		opts = append(opts, gochinadns.WithTestDomains(strings.Split(*flagTestDomains, ",")...))
+	if err != nil {
+		logrus.Fatalln(err)
 	}
-	if *flagCHNList != "" {
-		opts = append(opts, gochinadns.WithCHNList(*flagCHNList))
+	if cfg.Verbose {
+		logrus.SetLevel(logrus.DebugLevel)
 	}
-	if *flagIPBlacklist != "" {
-		opts = append(opts, gochinadns.WithIPBlacklist(*flagIPBlacklist))
+
+	if *flagCheckConfig {
+		cfg.SkipRefine = true
 	}
-	if *flagDomainBlacklist != "" {
-		opts = append(opts, gochinadns.WithDomainBlacklist(*flagDomainBlacklist))
+	client := gochinadns.NewClient(cfg.ClientOptions()...)
+	server, err := gochinadns.NewServer(client, cfg.ServerOptions()...)
+	if *flagCheckConfig {
+		if err != nil {
+			logrus.Fatalln("Invalid configuration:", err)
+		}
+		fmt.Println("Configuration OK.")
+		return
 	}
-	if *flagDomainPolluted != "" {
-		opts = append(opts, gochinadns.WithDomainPolluted(*flagDomainPolluted))
+	if err != nil {
+		panic(err)
 	}
 
-	copts := []gochinadns.ClientOption{
-		gochinadns.WithUDPMaxBytes(*flagUDPMaxBytes),
-		gochinadns.WithTCPOnly(*flagForceTCP),
-		gochinadns.WithMutation(*flagMutation),
-		gochinadns.WithTimeout(*flagTimeout),
-		gochinadns.WithDoHSkipQuerySelf(true),
-	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		// restore default behavior so that another signal kills chinadns immediately.
+		stop()
+		logrus.Info("Signal received. Shut down server gracefully.")
+	}()
 
-	client := gochinadns.NewClient(copts...)
-	server, err := gochinadns.NewServer(client, opts...)
-	if err != nil {
-		panic(err)
+	go reloadOnSignal(server)
+	if cfg.Lists.Watch {
+		go func() {
+			if err := server.WatchLists(ctx); err != nil {
+				logrus.WithError(err).Error("Fail to watch list files.")
+			}
+		}()
 	}
 
-	runUntilCanceled(context.Background(), server.Run)
+	runUntilCanceled(ctx, server.Run)
+	logrus.Info("Server stopped.")
+}
+
+// reloadOnSignal reloads lists of server on SIGHUP.
+func reloadOnSignal(server *gochinadns.Server) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		logrus.Info("SIGHUP received. Reload lists.")
+		if err := server.Reload(); err != nil {
+			logrus.WithError(err).Error("Fail to reload lists.")
+		}
+	}
 }
 
-func runUntilCanceled(ctx context.Context, f func() error) {
+// runUntilCanceled runs f again with exponential backoff if it fails or panics, until ctx is done.
+func runUntilCanceled(ctx context.Context, f func(context.Context) error) {
 	minGap := time.Millisecond * 100
 	maxGap := time.Second * 16
 	gap := minGap
@@ -82,7 +98,7 @@ func runUntilCanceled(ctx context.Context, f func() error) {
 					logrus.Errorf("%s:%s", r, string(debug.Stack()))
 				}
 			}()
-			err := f()
+			err := f(ctx)
 			if err == nil {
 				gap = minGap
 			} else {
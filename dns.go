@@ -4,14 +4,21 @@ import (
 	"context"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 )
 
-func lookupInServers(
-	ctx context.Context, cancel context.CancelFunc, result chan<- *dns.Msg, req *dns.Msg,
+// upstreamReply is a reply from an upstream resolver.
+type upstreamReply struct {
+	*dns.Msg
+	Server *Resolver
+}
+
+func (s *Server) lookupInServers(
+	ctx context.Context, cancel context.CancelFunc, result chan<- *upstreamReply, req *dns.Msg,
 	servers []*Resolver, waitInterval time.Duration, lookup LookupFunc,
 ) {
 	defer cancel()
@@ -19,6 +26,7 @@ func lookupInServers(
 		return
 	}
 	logger := logrus.WithField("question", questionString(&req.Question[0]))
+	servers = s.scores.sort(servers)
 
 	// TODO: replace ticker by ratelimit
 	ticker := time.NewTicker(waitInterval)
@@ -31,14 +39,26 @@ func lookupInServers(
 		defer wg.Done()
 		logger := logger.WithField("server", server.GetAddr())
 
-		reply, rtt, err := lookup(req.Copy(), server)
+		start := time.Now()
+		reply, rtt, err := lookup(ctx, req.Copy(), server)
+		if ctx.Err() != nil {
+			// aborted since a reply is chosen, which is not a failure of the server,
+			// but the server is known to be slower than the time elapsed.
+			logger.Debug("Query canceled.")
+			if s.ctx.Err() == nil {
+				s.scores.observeCanceled(server, time.Since(start))
+			}
+			return
+		}
+		s.metrics.observeLookup(server, rtt, err)
+		s.scores.observe(server, rtt, err)
 		if err != nil {
 			queryNext <- struct{}{}
 			return
 		}
 
 		select {
-		case result <- reply:
+		case result <- &upstreamReply{Msg: reply, Server: server}:
 			logger.Debug("Query RTT: ", rtt)
 		default:
 		}
@@ -66,20 +86,74 @@ LOOP:
 func (s *Server) Serve(w dns.ResponseWriter, req *dns.Msg) {
 	// Its client's responsibility to close this conn.
 	// defer w.Close()
-	var reply *dns.Msg
+	var (
+		reply  *dns.Msg
+		trace  *queryTrace
+		source string
+	)
 
 	start := time.Now()
-	qName := req.Question[0].Name
 	logger := logrus.WithField("question", questionString(&req.Question[0]))
+	defer func() {
+		elapsed := time.Since(start)
+		s.metrics.observeQuery(req, elapsed)
+		s.logQuery(w.RemoteAddr(), req, reply, source, trace, elapsed)
+		logger.WithField("source", source).Debug("SERVING RTT: ", elapsed)
+	}()
 
-	if s.DomainBlacklist.Contain(qName) {
-		reply = new(dns.Msg)
-		reply.SetReply(req)
+	if s.rules.Load().DomainBlacklist.Contain(req.Question[0].Name) {
+		s.metrics.observeBlacklist("domain")
+		reply, source = s.blockReply(req), sourceBlacklist
+		_ = w.WriteMsg(reply)
+		return
+	}
+
+	key := cacheKey(req)
+	if cached, prefetch := s.cache.Get(key); cached != nil {
+		s.metrics.observeCache("hit")
+		if prefetch {
+			go s.prefetch(key, req.Copy())
+		}
+		fixReply(cached, req)
+		reply, source = cached, sourceCache
 		_ = w.WriteMsg(reply)
 		return
 	}
+	if s.cache != nil {
+		s.metrics.observeCache("miss")
+	}
 
-	ctx, cancel := context.WithCancel(context.TODO())
+	if reply, trace = s.resolveShared(key, req, logger); reply != nil {
+		source = sourceUpstream
+	} else if reply = s.cache.GetStale(key); reply != nil {
+		s.metrics.observeCache("stale")
+		logger.Warn("No upstream reply. Serve stale answer from cache.")
+		fixReply(reply, req)
+		source = sourceStale
+	} else {
+		reply, source = new(dns.Msg), sourceNone
+		reply.SetReply(req)
+	}
+
+	_ = w.WriteMsg(reply)
+}
+
+// resolve races the request in trusted and untrusted servers, or looks it up in the resolver group
+// which the domain is routed to, and returns the chosen reply.
+// It returns nil if no reply is available. How the reply is chosen is recorded in trace.
+func (s *Server) resolve(req *dns.Msg, logger *logrus.Entry, trace *queryTrace) *dns.Msg {
+	s.normalizeRequest(req)
+	rules := s.rules.Load()
+	if group, ok := rules.DomainRoutes.Get(req.Question[0].Name); ok {
+		return s.resolveInGroup(req, logger, trace, group)
+	}
+	ranks := s.ranks.Load()
+	polluted := rules.DomainPolluted.Contain(req.Question[0].Name)
+	if !polluted && len(ranks.Untrusted) > 0 && rules.DomainChina.Contain(req.Question[0].Name) {
+		return s.resolveInGroup(req, logger, trace, groupUntrusted)
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
 	uctx, ucancel := context.WithCancel(ctx)
 	tctx, tcancel := context.WithCancel(ctx)
 	go func() {
@@ -88,37 +162,95 @@ func (s *Server) Serve(w dns.ResponseWriter, req *dns.Msg) {
 		cancel()
 	}()
 
-	s.normalizeRequest(req)
-
-	trusted := make(chan *dns.Msg, 1)
-	untrusted := make(chan *dns.Msg, 1)
-	go lookupInServers(tctx, tcancel, trusted, req, s.TrustedServers, s.Delay, s.Lookup)
-	if !s.DomainPolluted.Contain(qName) {
-		go lookupInServers(uctx, ucancel, untrusted, req, s.UntrustedServers, s.Delay, s.lookupNormal)
+	trusted := make(chan *upstreamReply, 1)
+	untrusted := make(chan *upstreamReply, 1)
+	go s.lookupInServers(tctx, tcancel, trusted, req, ranks.Trusted, s.Delay, s.LookupContext)
+	if !polluted {
+		go s.lookupInServers(uctx, ucancel, untrusted, req, ranks.Untrusted, s.Delay, s.lookupNormal)
 	} else {
 		ucancel()
 	}
 
+	var reply *upstreamReply
 	select {
 	case rep := <-untrusted:
-		reply = s.processReply(ctx, logger, rep, trusted, s.processUntrustedAnswer)
+		reply, trace.Branch = s.processReply(ctx, logger, trace, rep, branchUntrusted, trusted, s.processUntrustedAnswer)
 	case rep := <-trusted:
-		reply = s.processReply(ctx, logger, rep, untrusted, s.processTrustedAnswer)
+		reply, trace.Branch = s.processReply(ctx, logger, trace, rep, branchTrusted, untrusted, s.processTrustedAnswer)
 	case <-ctx.Done():
 	}
 	// notify lookupInServers to quit.
 	cancel()
 
-	if reply != nil {
-		// https://github.com/miekg/dns/issues/216
-		reply.Compress = true
-	} else {
-		reply = new(dns.Msg)
-		reply.SetReply(req)
+	if reply == nil {
+		return nil
 	}
+	trace.Resolver = reply.Server
+	s.metrics.observeBranch(trace.Branch)
+	return reply.Msg
+}
 
-	_ = w.WriteMsg(reply)
-	logger.Debug("SERVING RTT: ", time.Since(start))
+// resolveShared does the same as resolve, and caches the reply unless it's a fallback.
+// Concurrent identical requests are coalesced so that only one upstream lookup is in flight,
+// and every caller gets its own copy of the reply with ID and flags fixed up.
+func (s *Server) resolveShared(key string, req *dns.Msg, logger *logrus.Entry) (*dns.Msg, *queryTrace) {
+	type result struct {
+		reply *dns.Msg
+		trace *queryTrace
+	}
+	v, _, shared := s.inflight.Do(key, func() (interface{}, error) {
+		trace := new(queryTrace)
+		reply := s.resolve(req.Copy(), logger, trace)
+		if reply != nil {
+			// https://github.com/miekg/dns/issues/216
+			reply.Compress = true
+			// a fallback may be polluted, so trusted resolvers are tried again by the next query.
+			if trace.Branch != branchFallback {
+				s.cache.Set(key, reply)
+			}
+		}
+		return result{reply, trace}, nil
+	})
+	res := v.(result)
+	if res.reply == nil {
+		return nil, res.trace
+	}
+	if shared {
+		logger.Debug("Reply shared with identical in-flight queries.")
+	}
+
+	reply := res.reply.Copy()
+	fixReply(reply, req)
+	return reply, res.trace
+}
+
+// fixReply fixes up ID, flags and question of a cached or shared reply to match the request.
+func fixReply(reply, req *dns.Msg) {
+	reply.Id = req.Id
+	reply.RecursionDesired = req.RecursionDesired
+	reply.CheckingDisabled = req.CheckingDisabled
+	copy(reply.Question, req.Question)
+	// https://github.com/miekg/dns/issues/216
+	reply.Compress = true
+}
+
+// prefetch refreshes a popular cache entry in background before it expires.
+func (s *Server) prefetch(key string, req *dns.Msg) {
+	logger := logrus.WithField("question", questionString(&req.Question[0]))
+	reply, _ := s.resolveShared(key, req, logger)
+	if reply == nil {
+		failed := atomic.AddUint64(&s.prefetchFailed, 1)
+		logger.WithFields(logrus.Fields{
+			"prefetched": atomic.LoadUint64(&s.prefetched),
+			"failed":     failed,
+		}).Warn("Fail to prefetch cache entry.")
+		return
+	}
+	prefetched := atomic.AddUint64(&s.prefetched, 1)
+	logger.WithFields(logrus.Fields{
+		"prefetched": prefetched,
+		"failed":     atomic.LoadUint64(&s.prefetchFailed),
+	}).Debug("Cache entry prefetched.")
 }
 
 func (s *Server) normalizeRequest(req *dns.Msg) {
@@ -128,92 +260,78 @@ func (s *Server) normalizeRequest(req *dns.Msg) {
 	}
 }
 
+// processReply checks IPs in answers of rep from branch, and decides whether to use it by process.
+// It returns the chosen reply and the branch which won.
 func (s *Server) processReply(
-	ctx context.Context, logger *logrus.Entry, rep *dns.Msg, other <-chan *dns.Msg,
-	process func(context.Context, *logrus.Entry, *dns.Msg, net.IP, <-chan *dns.Msg) *dns.Msg,
-) (reply *dns.Msg) {
-	reply = rep
-	for i, rr := range rep.Answer {
-		switch answer := rr.(type) {
-		case *dns.A:
-			return process(ctx, logger, rep, answer.A, other)
-		case *dns.AAAA:
-			return process(ctx, logger, rep, answer.AAAA, other)
-		case *dns.CNAME:
-			if i < len(rep.Answer)-1 {
-				continue
-			}
-			logger.Debug("CNAME to ", answer.Target)
-			return
-		default:
-			return
-		}
+	ctx context.Context, logger *logrus.Entry, trace *queryTrace, rep *upstreamReply, branch string, other <-chan *upstreamReply,
+	process func(context.Context, *logrus.Entry, *queryTrace, *upstreamReply, []net.IP, <-chan *upstreamReply) (*upstreamReply, string),
+) (reply *upstreamReply, winner string) {
+	ips := answerIPs(rep.Msg)
+	if len(ips) == 0 {
+		logger.Debug("No IP in answers. Use it.")
+		return rep, branch
 	}
-	return
+	return process(ctx, logger, trace, rep, ips, other)
 }
 
-func (s *Server) processUntrustedAnswer(ctx context.Context, logger *logrus.Entry, rep *dns.Msg, answer net.IP, trusted <-chan *dns.Msg) (reply *dns.Msg) {
-	reply = rep
-	logger = logger.WithField("answer", answer)
+func (s *Server) processUntrustedAnswer(
+	ctx context.Context, logger *logrus.Entry, trace *queryTrace, rep *upstreamReply, answers []net.IP, trusted <-chan *upstreamReply,
+) (reply *upstreamReply, branch string) {
+	branch = branchUntrusted
+	rules := s.rules.Load()
+	logger = logger.WithField("answers", answers)
 
-	hit, err := s.IPBlacklist.Contains(answer)
-	if err != nil {
-		logger.WithError(err).Error("Blacklist CIDR error.")
-	}
-	if hit {
+	reply, answers = s.filterBlacklisted(logger, trace, rules, rep, answers)
+	switch {
+	case len(answers) == 0:
 		logger.Debug("Answer hit blacklist. Wait for trusted reply.")
-	} else {
-		contain, err := s.ChinaCIDR.Contains(answer)
-		if err != nil {
-			logger.WithError(err).Error("CIDR error.")
-		}
-		if contain {
-			logger.Debug("Answer belongs to China. Use it.")
-			return
-		}
+	case s.inChina(logger, rules, answers):
+		logger.Debug("Answer belongs to China. Use it.")
+		return
+	default:
 		logger.Debug("Answer is overseas. Wait for trusted reply.")
 	}
 
 	select {
 	case rep := <-trusted:
-		reply = s.processReply(ctx, logger, rep, nil, s.processTrustedAnswer)
+		reply, branch = s.processReply(ctx, logger, trace, rep, branchTrusted, nil, s.processTrustedAnswer)
 	case <-ctx.Done():
-		logger.Warn("No trusted reply. Use this as fallback.")
+		branch = branchFallback
+		if reply != rep {
+			logger.Warn("No trusted reply. Use the stripped answer as fallback.")
+		} else {
+			logger.Warn("No trusted reply. Use this as fallback.")
+		}
 	}
 	return
 }
 
-func (s *Server) processTrustedAnswer(ctx context.Context, logger *logrus.Entry, rep *dns.Msg, answer net.IP, untrusted <-chan *dns.Msg) (reply *dns.Msg) {
-	reply = rep
-	logger = logger.WithField("answer", answer)
+func (s *Server) processTrustedAnswer(
+	ctx context.Context, logger *logrus.Entry, trace *queryTrace, rep *upstreamReply, answers []net.IP, untrusted <-chan *upstreamReply,
+) (reply *upstreamReply, branch string) {
+	branch = branchTrusted
+	rules := s.rules.Load()
+	logger = logger.WithField("answers", answers)
 
-	hit, err := s.IPBlacklist.Contains(answer)
-	if err != nil {
-		logger.WithError(err).Error("Blacklist CIDR error.")
-	}
-	if hit {
-		logger.Debug("Answer hit blacklist. Wait for trusted reply.")
-	} else {
-		if !s.Bidirectional {
-			logger.Debug("Answer is trusted. Use it.")
-			return
-		}
-
-		contain, err := s.ChinaCIDR.Contains(answer)
-		if err != nil {
-			logger.WithError(err).Error("CIDR error.")
-		}
-		if !contain {
-			logger.Debug("Answer is trusted and overseas. Use it.")
-			return
-		}
+	reply, answers = s.filterBlacklisted(logger, trace, rules, rep, answers)
+	switch {
+	case len(answers) == 0:
+		logger.Debug("Answer hit blacklist. Wait for untrusted reply.")
+	case !s.Bidirectional:
+		logger.Debug("Answer is trusted. Use it.")
+		return
+	case !s.inChina(logger, rules, answers):
+		logger.Debug("Answer is trusted and overseas. Use it.")
+		return
+	default:
 		logger.Debug("Answer may not be the nearest. Wait for untrusted reply.")
 	}
 
 	select {
 	case rep := <-untrusted:
-		reply = s.processReply(ctx, logger, rep, nil, s.processUntrustedAnswer)
+		reply, branch = s.processReply(ctx, logger, trace, rep, branchUntrusted, nil, s.processUntrustedAnswer)
 	case <-ctx.Done():
+		branch = branchFallback
 		logger.Debug("No untrusted reply. Use this as fallback.")
 	}
 	return
@@ -0,0 +1,144 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestLookupInServersCancelLosers(t *testing.T) {
+	up, down := new(atomic.Bool), new(atomic.Bool)
+	down.Store(true)
+	s, err := NewServer(NewClient(WithTimeout(5*time.Second)),
+		WithTrustedResolvers(false, "udp@"+startUpstream(t, flakyHandler(down)), "udp@"+startUpstream(t, flakyHandler(up))),
+		WithDisableScoring(true),
+		WithSkipRefineResolvers(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan *upstreamReply, 1)
+	start := time.Now()
+	s.lookupInServers(ctx, cancel, result, req, s.TrustedServers, 50*time.Millisecond, s.LookupContext)
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Lookups of losers should be aborted once a reply is chosen, took %s", elapsed)
+	}
+	select {
+	case reply := <-result:
+		if reply.Server != s.TrustedServers[1] {
+			t.Errorf("Reply should come from the server which is up, got %s", reply.Server)
+		}
+	default:
+		t.Error("Reply should be chosen")
+	}
+}
+
+// slowHandler replies to every query after delay.
+func slowHandler(delay time.Duration) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(delay)
+		answerA(w, req)
+	}
+}
+
+func TestLookupInServersScoreLosers(t *testing.T) {
+	s, err := NewServer(NewClient(WithTimeout(time.Second)),
+		WithTrustedResolvers(false, "udp@"+startUpstream(t, slowHandler(300*time.Millisecond)), "udp@"+startUpstream(t, slowHandler(0))),
+		WithSkipRefineResolvers(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow, fast := s.TrustedServers[0], s.TrustedServers[1]
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		result := make(chan *upstreamReply, 1)
+		s.lookupInServers(ctx, cancel, result, req, s.TrustedServers, 50*time.Millisecond, s.LookupContext)
+		if reply := <-result; reply.Server != fast {
+			t.Fatalf("Reply should come from the fast server, got %s", reply.Server)
+		}
+	}
+	if sorted := s.scores.sort(s.TrustedServers); sorted[0] != fast {
+		t.Errorf("Fast server should be preferred to the slow one which always loses, got %v", sorted)
+	}
+	if _, ok := s.scores.cost(slow); !ok {
+		t.Error("Slow server which always loses should be scored")
+	}
+}
+
+// testWriter is a dns.ResponseWriter recording the message written.
+type testWriter struct {
+	dns.ResponseWriter
+	reply *dns.Msg
+}
+
+func (w *testWriter) RemoteAddr() net.Addr { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+
+func (w *testWriter) WriteMsg(m *dns.Msg) error {
+	w.reply = m
+	return nil
+}
+
+func TestServeCoalesceQueries(t *testing.T) {
+	var queries atomic.Int32
+	addr := startUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		queries.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		answerA(w, req, "1.1.1.1")
+	})
+	s, err := NewServer(NewClient(WithTimeout(time.Second)),
+		WithTrustedResolvers(false, addr),
+		WithDisableCache(true),
+		WithDelay(time.Second),
+		WithSkipRefineResolvers(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 8
+	names := []string{"www.example.com.", "WWW.Example.COM.", "www.EXAMPLE.com.", "Www.example.Com."}
+	reqs, writers := make([]*dns.Msg, n), make([]*testWriter, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion(names[i%len(names)], dns.TypeA)
+		req.Id = uint16(1000 + i)
+		req.RecursionDesired = i%2 == 0
+		req.CheckingDisabled = i%3 == 0
+		reqs[i], writers[i] = req, new(testWriter)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.Serve(writers[i], reqs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	if q := queries.Load(); q != 1 {
+		t.Errorf("Identical concurrent queries should hit the upstream once, got %d", q)
+	}
+	for i, w := range writers {
+		req, reply := reqs[i], w.reply
+		if reply == nil || len(reply.Answer) != 1 {
+			t.Fatalf("Query %d should be answered, got %v", i, reply)
+		}
+		if reply.Id != req.Id || reply.RecursionDesired != req.RecursionDesired ||
+			reply.CheckingDisabled != req.CheckingDisabled {
+			t.Errorf("Reply %d should have ID and flags of its request, got %v", i, reply.MsgHdr)
+		}
+		if reply.Question[0].Name != req.Question[0].Name {
+			t.Errorf("Reply %d should keep the question case %s, got %s", i, req.Question[0].Name, reply.Question[0].Name)
+		}
+	}
+}
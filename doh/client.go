@@ -1,11 +1,17 @@
 package doh
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -19,6 +25,8 @@ var ErrQueryMyself = errors.New("not allowed to query myself")
 type clientOptions struct {
 	Timeout         time.Duration
 	SkipQueryMyself bool
+	Method          string
+	IdleConnTimeout time.Duration
 }
 
 type ClientOption func(*clientOptions)
@@ -40,25 +48,113 @@ func WithSkipQueryMySelf(skip bool) ClientOption {
 	}
 }
 
+// WithMethod sets the HTTP method of DoH requests, GET or POST. Defaults to GET.
+// POST requests carry the DNS message in body, which avoids URL length limits for long queries.
+// https://tools.ietf.org/html/rfc8484#section-4.1
+func WithMethod(method string) ClientOption {
+	return func(o *clientOptions) {
+		if method != "" {
+			o.Method = strings.ToUpper(method)
+		}
+	}
+}
+
+// WithIdleConnTimeout controls how long an idle HTTP connection is kept alive for reuse.
+func WithIdleConnTimeout(t time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.IdleConnTimeout = t
+	}
+}
+
 type Client struct {
-	opt *clientOptions
-	cli *http.Client
+	opt    *clientOptions
+	cli    *http.Client
+	dialer *net.Dialer
+
+	mu        sync.RWMutex
+	bootstrap map[string][]string // bootstrap IPs of DoH servers, keyed by hostname
 }
 
 func NewClient(opts ...ClientOption) *Client {
-	o := new(clientOptions)
+	o := &clientOptions{
+		Method:          http.MethodGet,
+		IdleConnTimeout: 90 * time.Second,
+	}
 	for _, f := range opts {
 		f(o)
 	}
-	return &Client{
-		opt: o,
-		cli: &http.Client{
-			Timeout: o.Timeout,
+	c := &Client{
+		opt:       o,
+		dialer:    &net.Dialer{Timeout: o.Timeout, KeepAlive: 30 * time.Second},
+		bootstrap: make(map[string][]string),
+	}
+	c.cli = &http.Client{
+		Timeout: o.Timeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         c.dialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     o.IdleConnTimeout,
+			TLSHandshakeTimeout: o.Timeout,
 		},
 	}
+	return c
+}
+
+// dialContext dials the bootstrap IPs of addr's host in order if there are any,
+// otherwise the host is resolved by system resolver.
+func (c *Client) dialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return c.dialer.DialContext(ctx, network, addr)
+	}
+	c.mu.RLock()
+	ips := c.bootstrap[host]
+	c.mu.RUnlock()
+	if len(ips) == 0 {
+		return c.dialer.DialContext(ctx, network, addr)
+	}
+
+	for _, ip := range ips {
+		if conn, err = c.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+			return
+		}
+		logrus.WithError(err).Debugf("Fail to dial bootstrap IP %s of %s.", ip, host)
+	}
+	return
+}
+
+// setBootstrap registers bootstrap IPs of the host of address.
+func (c *Client) setBootstrap(address string, bootstrap []string) error {
+	u, err := url.Parse(address)
+	if err != nil {
+		return err
+	}
+	host := u.Hostname()
+
+	c.mu.RLock()
+	ips := c.bootstrap[host]
+	c.mu.RUnlock()
+	if equalStrings(ips, bootstrap) {
+		return nil
+	}
+	c.mu.Lock()
+	c.bootstrap[host] = bootstrap
+	c.mu.Unlock()
+	return nil
+}
+
+// Exchange sends a DNS request to the DoH server at address (an URL).
+// If bootstrap IPs are given, the server is dialed with these IPs directly instead of resolving its host.
+func (c *Client) Exchange(req *dns.Msg, address string, bootstrap ...string) (r *dns.Msg, rtt time.Duration, err error) {
+	return c.ExchangeContext(context.Background(), req, address, bootstrap...)
 }
 
-func (c *Client) Exchange(req *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error) {
+// ExchangeContext does the same as Exchange, and aborts the request once ctx is done.
+func (c *Client) ExchangeContext(
+	ctx context.Context, req *dns.Msg, address string, bootstrap ...string,
+) (r *dns.Msg, rtt time.Duration, err error) {
 	var (
 		buf, b64 []byte
 		begin    = time.Now()
@@ -75,20 +171,40 @@ func (c *Client) Exchange(req *dns.Msg, address string) (r *dns.Msg, rtt time.Du
 		}
 	}
 
+	if len(bootstrap) > 0 {
+		if err = c.setBootstrap(address, bootstrap); err != nil {
+			return
+		}
+	}
+
 	// Set DNS ID as zero accoreding to RFC8484 (cache friendly)
 	req.Id = 0
 	buf, err = req.Pack()
-	b64 = make([]byte, base64.RawURLEncoding.EncodedLen(len(buf)))
+	req.Id = origID
 	if err != nil {
 		return
 	}
-	base64.RawURLEncoding.Encode(b64, buf)
 
-	// No need to use hreq.URL.Query()
-	uri := address + "?dns=" + string(b64)
-	logrus.Debugln("DoH request:", uri)
-	hreq, _ := http.NewRequest("GET", uri, nil)
-	hreq.Header.Add("Accept", DoHMediaType)
+	var hreq *http.Request
+	if c.opt.Method == http.MethodPost {
+		logrus.Debugln("DoH POST request:", address)
+		hreq, err = http.NewRequestWithContext(ctx, http.MethodPost, address, bytes.NewReader(buf))
+		if err != nil {
+			return
+		}
+		hreq.Header.Set("Content-Type", DoHMediaType)
+	} else {
+		b64 = make([]byte, base64.RawURLEncoding.EncodedLen(len(buf)))
+		base64.RawURLEncoding.Encode(b64, buf)
+		// No need to use hreq.URL.Query()
+		uri := address + "?dns=" + string(b64)
+		logrus.Debugln("DoH request:", uri)
+		hreq, err = http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+		if err != nil {
+			return
+		}
+	}
+	hreq.Header.Set("Accept", DoHMediaType)
 	resp, err := c.cli.Do(hreq)
 	if err != nil {
 		return
@@ -105,8 +221,67 @@ func (c *Client) Exchange(req *dns.Msg, address string) (r *dns.Msg, rtt time.Du
 	}
 
 	r = new(dns.Msg)
-	err = r.Unpack(content)
+	if err = r.Unpack(content); err != nil {
+		return
+	}
 	r.Id = origID
+	if maxAge, ok := freshness(resp.Header); ok {
+		capTTL(r, maxAge)
+	}
 	rtt = time.Since(begin)
 	return
 }
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// freshness returns the remaining freshness lifetime (in seconds) of a DoH response, which is its
+// Cache-Control max-age minus Age. ok is false if max-age is absent.
+// https://tools.ietf.org/html/rfc8484#section-5.1
+func freshness(h http.Header) (lifetime uint32, ok bool) {
+	var maxAge int64 = -1
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(strings.ToLower(directive))
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		v, err := strconv.ParseInt(strings.TrimPrefix(directive, "max-age="), 10, 64)
+		if err != nil || v < 0 {
+			return 0, false
+		}
+		maxAge = v
+	}
+	if maxAge < 0 {
+		return 0, false
+	}
+	if age, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && age > 0 {
+		maxAge -= age
+	}
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	if maxAge > int64(^uint32(0)) {
+		maxAge = int64(^uint32(0))
+	}
+	return uint32(maxAge), true
+}
+
+// capTTL caps TTLs of all resource records except OPT in msg to ttl.
+func capTTL(msg *dns.Msg, ttl uint32) {
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT && hdr.Ttl > ttl {
+				hdr.Ttl = ttl
+			}
+		}
+	}
+}
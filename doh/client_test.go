@@ -0,0 +1,162 @@
+package doh
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestExchange(t *testing.T) {
+	var protos []int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos = append(protos, r.ProtoMajor)
+		var buf []byte
+		switch r.Method {
+		case http.MethodGet:
+			buf, _ = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != DoHMediaType {
+				http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			buf, _ = io.ReadAll(r.Body)
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		reply.Answer = append(reply.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("1.2.3.4"),
+		})
+		out, _ := reply.Pack()
+		w.Header().Set("Content-Type", DoHMediaType)
+		w.Header().Set("Cache-Control", "max-age=100")
+		w.Header().Set("Age", "40")
+		_, _ = w.Write(out)
+	})
+	server := httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		t.Run(method, func(t *testing.T) {
+			protos = nil
+			cli := NewClient(WithMethod(method))
+			cli.cli.Transport.(*http.Transport).TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+
+			for i := 0; i < 2; i++ {
+				req := new(dns.Msg)
+				req.SetQuestion("example.com.", dns.TypeA)
+				reply, _, err := cli.Exchange(req, server.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if reply.Id != req.Id || req.Id == 0 {
+					t.Errorf("Reply ID %d should match request ID %d", reply.Id, req.Id)
+				}
+				if len(reply.Answer) != 1 {
+					t.Fatalf("Unexpected reply: %v", reply)
+				}
+				if ttl := reply.Answer[0].Header().Ttl; ttl != 60 {
+					t.Errorf("TTL should be capped to max-age minus age 60, got %d", ttl)
+				}
+			}
+			for _, proto := range protos {
+				if proto != 2 {
+					t.Errorf("HTTP/2 should be used, got HTTP/%d", proto)
+				}
+			}
+		})
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	tests := []struct {
+		cacheControl, age string
+		want              uint32
+		wantOK            bool
+	}{
+		{"", "", 0, false},
+		{"no-cache", "", 0, false},
+		{"max-age=300", "", 300, true},
+		{"public, max-age=300", "100", 200, true},
+		{"max-age=300", "400", 0, true},
+		{"max-age=abc", "", 0, false},
+	}
+	for _, tt := range tests {
+		h := make(http.Header)
+		h.Set("Cache-Control", tt.cacheControl)
+		h.Set("Age", tt.age)
+		got, ok := freshness(h)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("freshness(%q, %q) = %d, %v, want %d, %v", tt.cacheControl, tt.age, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		out, _ := reply.Pack()
+		_, _ = w.Write(out)
+	}))
+	defer server.Close()
+
+	cli := NewClient()
+	cli.cli.Transport.(*http.Transport).TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	// The certificate of httptest server is valid for example.com
+	address := "https://example.com:" + port + "/dns-query"
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	if _, _, err := cli.Exchange(req, address, "127.0.0.2", "127.0.0.1"); err != nil {
+		t.Fatal("Should fall back to the second bootstrap IP: ", err)
+	}
+}
+
+func TestExchangeContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	cli := NewClient(WithTimeout(5 * time.Second))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	start := time.Now()
+	if _, _, err := cli.ExchangeContext(ctx, req, server.URL); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Exchange should be aborted by context, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Exchange should be aborted once context is done, took %s", elapsed)
+	}
+}
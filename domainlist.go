@@ -0,0 +1,264 @@
+package gochinadns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Formats of domain lists.
+const (
+	ListFormatAuto    = "auto"    // detect format of each line, and decode base64 encoded gfwlist
+	ListFormatPlain   = "plain"   // one domain per line
+	ListFormatDnsmasq = "dnsmasq" // dnsmasq conf like `server=/example.com/114.114.114.114`
+	ListFormatGFWList = "gfwlist" // AutoProxy rules like `||example.com`, optionally base64 encoded
+	ListFormatHosts   = "hosts"   // hosts file like `0.0.0.0 example.com`
+	ListFormatAdblock = "adblock" // Adblock rules like `||example.com^`
+)
+
+var listFormats = map[string]bool{
+	ListFormatAuto:    true,
+	ListFormatPlain:   true,
+	ListFormatDnsmasq: true,
+	ListFormatGFWList: true,
+	ListFormatHosts:   true,
+	ListFormatAdblock: true,
+}
+
+// splitListFormat splits path in format `format:path` into format and path.
+// Format defaults to auto if path is not prefixed by a known format.
+func splitListFormat(path string) (format, file string) {
+	if i := strings.IndexByte(path, ':'); i > 0 && listFormats[path[:i]] {
+		return path[:i], path[i+1:]
+	}
+	return ListFormatAuto, path
+}
+
+// loadDomainList reads domain rules from the list file at path in format, and calls add with each of them.
+// Comments, blank lines and rules which can not be converted to domain rules are skipped.
+func loadDomainList(path, format string, add func(rule string) error) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if format == ListFormatAuto || format == ListFormatGFWList {
+		if decoded, ok := decodeGFWList(content); ok {
+			content, format = decoded, ListFormatGFWList
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		for _, rule := range parseDomainListLine(scanner.Text(), format) {
+			if err := add(rule); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// decodeGFWList decodes base64 encoded gfwlist, which starts with an AutoProxy header like `[AutoProxy 0.2.9]`.
+func decodeGFWList(content []byte) ([]byte, bool) {
+	content = bytes.Join(bytes.Fields(content), nil)
+	if len(content) == 0 {
+		return nil, false
+	}
+	decoded, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(content)))
+	if err != nil || !bytes.HasPrefix(decoded, []byte("[AutoProxy")) {
+		return nil, false
+	}
+	return decoded, true
+}
+
+// parseDomainListLine parses domain rules accepted by domainTrie.Add from a line of domain list in format.
+func parseDomainListLine(line, format string) []string {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+	if format == ListFormatAuto {
+		format = detectListFormat(line)
+	}
+
+	switch format {
+	case ListFormatDnsmasq:
+		return parseDnsmasqLine(line)
+	case ListFormatHosts:
+		return parseHostsLine(line)
+	case ListFormatGFWList, ListFormatAdblock:
+		if rule := parseAdblockLine(line); rule != "" {
+			return []string{rule}
+		}
+		return nil
+	default:
+		if rule := parsePlainLine(line); rule != "" {
+			return []string{rule}
+		}
+		return nil
+	}
+}
+
+// parsePlainLine parses a domain rule like `example.com`, `full:example.com` or `@@keyword:example`.
+func parsePlainLine(line string) string {
+	if line[0] == '#' {
+		return ""
+	}
+	rule := strings.TrimPrefix(line, "@@")
+	prefix := line[:len(line)-len(rule)]
+
+	kind, value, ok := strings.Cut(rule, ":")
+	switch {
+	case !ok:
+		// "." contains all domains
+		if domain := firstField(rule); domain == "." || isDomainName(domain) {
+			return prefix + domain
+		}
+	case kind == "regexp":
+		return prefix + rule
+	case kind == "keyword":
+		if keyword := firstField(value); keyword != "" {
+			return prefix + kind + ":" + keyword
+		}
+	case kind == "domain" || kind == "full":
+		if domain := firstField(value); isDomainName(domain) {
+			return prefix + kind + ":" + domain
+		}
+	}
+	return ""
+}
+
+// firstField returns the first field of s separated by white spaces, or empty if there is none.
+func firstField(s string) string {
+	if fields := strings.Fields(s); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
+}
+
+// detectListFormat detects format of a line in domain list.
+func detectListFormat(line string) string {
+	if rule := strings.TrimPrefix(line, "@@"); !strings.HasPrefix(rule, "|") && isRuleTyped(rule) {
+		return ListFormatPlain
+	}
+	switch {
+	case line[0] == '#', line[0] == '!', line[0] == '[':
+		return ListFormatAdblock // comments and headers, which are skipped anyway
+	case strings.HasPrefix(line, "|"), strings.HasPrefix(line, "@@"), strings.HasPrefix(line, "/"):
+		return ListFormatAdblock
+	case strings.Contains(line, "=/"):
+		return ListFormatDnsmasq
+	}
+	if fields := strings.Fields(line); len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+		return ListFormatHosts
+	}
+	return ListFormatPlain
+}
+
+// isRuleTyped reports whether rule is prefixed by a type accepted by domainTrie.Add, like `full:`.
+func isRuleTyped(rule string) bool {
+	for _, kind := range []string{"domain:", "full:", "keyword:", "regexp:"} {
+		if strings.HasPrefix(rule, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDnsmasqLine parses domains from dnsmasq options like `server=/a.com/b.com/1.2.3.4` or `address=/a.com/`.
+func parseDnsmasqLine(line string) []string {
+	if line[0] == '#' {
+		return nil
+	}
+	_, value, ok := strings.Cut(line, "=")
+	if !ok || !strings.HasPrefix(value, "/") {
+		return nil
+	}
+	fields := strings.Split(value[1:], "/")
+	var domains []string
+	// the last field is the server, address or set name
+	for _, domain := range fields[:len(fields)-1] {
+		if isDomainName(domain) {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// parseHostsLine parses domains from a line of hosts file like `0.0.0.0 a.com b.com # comment`.
+func parseHostsLine(line string) []string {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return nil
+	}
+	var domains []string
+	for _, domain := range fields[1:] {
+		switch domain {
+		case "localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback":
+			continue
+		}
+		if isDomainName(domain) && net.ParseIP(domain) == nil {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// parseAdblockLine parses the domain rule from an Adblock or AutoProxy rule like `||a.com^`, `|http://a.com/`,
+// `.a.com` or exception `@@||a.com^`. It returns empty for comments, regular expressions and rules not matching
+// a whole domain, like `|http://a.com/path`.
+func parseAdblockLine(line string) string {
+	prefix := ""
+	if rule := strings.TrimPrefix(line, "@@"); rule != line && rule != "" {
+		prefix, line = "@@", rule
+	}
+	switch {
+	case line[0] == '!', line[0] == '#', line[0] == '[', line[0] == '/', line[0] == '@':
+		return ""
+	}
+	if i := strings.IndexByte(line, '$'); i >= 0 {
+		line = line[:i]
+	}
+
+	domain := line
+	switch {
+	case strings.HasPrefix(domain, "||"):
+		domain = domain[2:]
+	case strings.HasPrefix(domain, "|"):
+		domain = domain[1:]
+		if i := strings.Index(domain, "://"); i >= 0 {
+			domain = domain[i+3:]
+		}
+	default:
+		domain = strings.TrimPrefix(domain, ".")
+	}
+	if i := strings.IndexAny(domain, "^/:"); i >= 0 {
+		if j := strings.IndexByte(domain[i:], '/'); j >= 0 && strings.Trim(domain[i+j:], "/^*|") != "" {
+			return "" // only URLs with the path are matched
+		}
+		domain = domain[:i]
+	}
+	if !isDomainName(domain) {
+		return ""
+	}
+	return prefix + domain
+}
+
+// isDomainName reports whether s looks like a domain name, without wildcards.
+func isDomainName(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || strings.ContainsAny(s, "*/:@=^|") {
+		return false
+	}
+	_, ok := dns.IsDomainName(s)
+	return ok
+}
@@ -0,0 +1,110 @@
+package gochinadns
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitListFormat(t *testing.T) {
+	tests := []struct{ path, format, file string }{
+		{"./list.txt", ListFormatAuto, "./list.txt"},
+		{"gfwlist:./gfwlist.txt", ListFormatGFWList, "./gfwlist.txt"},
+		{"hosts:/etc/hosts", ListFormatHosts, "/etc/hosts"},
+		{"C:/list.txt", ListFormatAuto, "C:/list.txt"},
+		{"unknown:list.txt", ListFormatAuto, "unknown:list.txt"},
+	}
+	for _, tt := range tests {
+		if format, file := splitListFormat(tt.path); format != tt.format || file != tt.file {
+			t.Errorf("splitListFormat(%q) = %q, %q, want %q, %q", tt.path, format, file, tt.format, tt.file)
+		}
+	}
+}
+
+func TestParseDomainListLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		format  string
+		domains []string
+	}{
+		{"", ListFormatAuto, nil},
+		{"# comment", ListFormatAuto, nil},
+		{"! comment", ListFormatAuto, nil},
+		{"[AutoProxy 0.2.9]", ListFormatAuto, nil},
+		{"example.com", ListFormatAuto, []string{"example.com"}},
+		{"example.com # comment", ListFormatAuto, []string{"example.com"}},
+		{".", ListFormatAuto, []string{"."}},
+		{"server=/a.com/b.com/114.114.114.114", ListFormatAuto, []string{"a.com", "b.com"}},
+		{"address=/a.com/", ListFormatAuto, []string{"a.com"}},
+		{"0.0.0.0 a.com b.com # comment", ListFormatAuto, []string{"a.com", "b.com"}},
+		{"127.0.0.1 localhost", ListFormatAuto, nil},
+		{"0.0.0.0 0.0.0.0", ListFormatAuto, nil},
+		{"0.0.0.0 1.2.3.4 a.com", ListFormatHosts, []string{"a.com"}},
+		{"||a.com^", ListFormatAuto, []string{"a.com"}},
+		{"||a.com^$third-party", ListFormatAuto, []string{"a.com"}},
+		{"|http://a.com/path", ListFormatAuto, nil},
+		{"|http://a.com/", ListFormatAuto, []string{"a.com"}},
+		{"|https://a.com:8443/path", ListFormatAuto, nil},
+		{"|http://a.com:8080", ListFormatAuto, []string{"a.com"}},
+		{"||a.com/*", ListFormatAuto, []string{"a.com"}},
+		{"@@||a.com^", ListFormatAuto, []string{"@@a.com"}},
+		{"@@a.com", ListFormatAuto, []string{"@@a.com"}},
+		{"full:a.com", ListFormatAuto, []string{"full:a.com"}},
+		{"@@domain:a.com # comment", ListFormatAuto, []string{"@@domain:a.com"}},
+		{"keyword:google", ListFormatAuto, []string{"keyword:google"}},
+		{"regexp:^ad[0-9]+\\.", ListFormatAuto, []string{"regexp:^ad[0-9]+\\."}},
+		{"full:*.a.com", ListFormatAuto, nil},
+		{"@@", ListFormatPlain, nil},
+		{"@@", ListFormatAuto, nil},
+		{"@@keyword:\t", ListFormatPlain, nil},
+		{"@@domain: ", ListFormatPlain, nil},
+		{"full:", ListFormatPlain, nil},
+		{"/^https?:\\/\\/a\\.com/", ListFormatAuto, nil},
+		{"||*.a.com", ListFormatAuto, nil},
+		{".a.com", ListFormatGFWList, []string{"a.com"}},
+		{"a.com/path", ListFormatGFWList, nil},
+		{"server=/a.com/1.1.1.1", ListFormatPlain, nil},
+		{"a.com", ListFormatHosts, nil},
+		{"a.com", ListFormatDnsmasq, nil},
+	}
+	for _, tt := range tests {
+		if domains := parseDomainListLine(tt.line, tt.format); !reflect.DeepEqual(domains, tt.domains) {
+			t.Errorf("parseDomainListLine(%q, %s) = %v, want %v", tt.line, tt.format, domains, tt.domains)
+		}
+	}
+}
+
+func TestLoadDomainList(t *testing.T) {
+	gfwlist := "[AutoProxy 0.2.9]\n! comment\n||google.com\n|http://t.co/\n|http://a.com/path\n@@||google.cn\n.twitter.com\n/^https?:\\/\\/[^\\/]+blogspot\\.(.*)/\n"
+	path := filepath.Join(t.TempDir(), "gfwlist.txt")
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString([]byte(gfwlist))), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{ListFormatAuto, ListFormatGFWList} {
+		var domains []string
+		add := func(rule string) error {
+			domains = append(domains, rule)
+			return nil
+		}
+		if err := loadDomainList(path, format, add); err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"google.com", "t.co", "@@google.cn", "twitter.com"}; !reflect.DeepEqual(domains, want) {
+			t.Errorf("Domains in base64 encoded gfwlist should be %v, got %v", want, domains)
+		}
+	}
+
+	trie := new(domainTrie)
+	if err := loadDomainList(filepath.Join(t.TempDir(), "missing.txt"), ListFormatAuto, trie.Add); err == nil {
+		t.Error("Loading a missing list should fail")
+	}
+	if err := os.WriteFile(path, []byte("regexp:(\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadDomainList(path, ListFormatAuto, trie.Add); err == nil {
+		t.Error("Loading a list with invalid regular expression should fail")
+	}
+}
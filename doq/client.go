@@ -0,0 +1,209 @@
+package doq
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// NextProto is the ALPN token of DNS-over-QUIC: https://tools.ietf.org/html/rfc9250#section-4.1.1
+const NextProto = "doq"
+
+type clientOptions struct {
+	Timeout time.Duration
+	RootCAs *x509.CertPool
+}
+
+type ClientOption func(*clientOptions)
+
+// WithTimeout set a DNS query timeout
+func WithTimeout(t time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.Timeout = t
+	}
+}
+
+// WithRootCAs sets the root certificates to verify servers. System roots are used by default.
+func WithRootCAs(pool *x509.CertPool) ClientOption {
+	return func(o *clientOptions) {
+		o.RootCAs = pool
+	}
+}
+
+// Client is a DNS-over-QUIC client (RFC 9250). Queries to the same server are multiplexed
+// as streams over a single QUIC connection. It is safe for concurrent use.
+type Client struct {
+	opt      *clientOptions
+	sessions tls.ClientSessionCache
+
+	mu    sync.Mutex
+	conns map[string]*quic.Conn
+}
+
+func NewClient(opts ...ClientOption) *Client {
+	o := new(clientOptions)
+	for _, f := range opts {
+		f(o)
+	}
+	return &Client{
+		opt:      o,
+		sessions: tls.NewLRUClientSessionCache(0),
+		conns:    make(map[string]*quic.Conn),
+	}
+}
+
+// Exchange sends a DNS request to address (in ip:port format) over QUIC, and verifies the server certificate
+// against serverName.
+func (c *Client) Exchange(req *dns.Msg, address, serverName string) (r *dns.Msg, rtt time.Duration, err error) {
+	return c.ExchangeContext(context.Background(), req, address, serverName)
+}
+
+// ExchangeContext does the same as Exchange, and aborts the request once ctx is done.
+func (c *Client) ExchangeContext(
+	ctx context.Context, req *dns.Msg, address, serverName string,
+) (r *dns.Msg, rtt time.Duration, err error) {
+	begin := time.Now()
+	if c.opt.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opt.Timeout)
+		defer cancel()
+	}
+
+	// The DNS Message ID MUST be set to 0: https://tools.ietf.org/html/rfc9250#section-4.2.1
+	msg := req.Copy()
+	msg.Id = 0
+	buf, err := msg.Pack()
+	if err != nil {
+		return
+	}
+
+	key := address + "#" + serverName
+	conn, reused, err := c.getConn(ctx, key, address, serverName)
+	if err != nil {
+		return
+	}
+	r, err = exchange(ctx, conn, buf)
+	if err != nil && reused && ctx.Err() == nil && connClosed(conn, err) {
+		// The connection may have been closed by server. Retry with a new one.
+		c.removeConn(key, conn)
+		if conn, _, err = c.getConn(ctx, key, address, serverName); err != nil {
+			return
+		}
+		r, err = exchange(ctx, conn, buf)
+	}
+	if err != nil {
+		// Errors of the stream only fail this request, and the connection is kept for other requests sharing it.
+		if connClosed(conn, err) {
+			c.removeConn(key, conn)
+		}
+		return
+	}
+	r.Id = req.Id
+	rtt = time.Since(begin)
+	return
+}
+
+func (c *Client) getConn(ctx context.Context, key, address, serverName string) (conn *quic.Conn, reused bool, err error) {
+	c.mu.Lock()
+	conn = c.conns[key]
+	c.mu.Unlock()
+	if conn != nil && conn.Context().Err() == nil {
+		return conn, true, nil
+	}
+
+	conn, err = quic.DialAddr(ctx, address, &tls.Config{
+		ServerName:         serverName,
+		RootCAs:            c.opt.RootCAs,
+		NextProtos:         []string{NextProto},
+		ClientSessionCache: c.sessions,
+	}, nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old := c.conns[key]; old != nil && old.Context().Err() == nil {
+		// Another goroutine has established a connection concurrently.
+		_ = conn.CloseWithError(0, "")
+		return old, false, nil
+	}
+	c.conns[key] = conn
+	return conn, false, nil
+}
+
+func (c *Client) removeConn(key string, conn *quic.Conn) {
+	c.mu.Lock()
+	if c.conns[key] == conn {
+		delete(c.conns, key)
+	}
+	c.mu.Unlock()
+	_ = conn.CloseWithError(0, "")
+}
+
+// connClosed reports whether err is caused by the connection rather than a single stream,
+// in which case the connection can not be used anymore.
+func connClosed(conn *quic.Conn, err error) bool {
+	if conn.Context().Err() != nil {
+		return true
+	}
+	var (
+		appErr       *quic.ApplicationError
+		idleErr      *quic.IdleTimeoutError
+		resetErr     *quic.StatelessResetError
+		transportErr *quic.TransportError
+	)
+	return errors.As(err, &appErr) || errors.As(err, &idleErr) || errors.As(err, &resetErr) ||
+		errors.As(err, &transportErr)
+}
+
+// exchange sends a DNS message in a new stream, prefixed with a two-octet length field.
+// https://tools.ietf.org/html/rfc9250#section-4.2
+func exchange(ctx context.Context, conn *quic.Conn, buf []byte) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ddl, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(ddl)
+	}
+	// unblock reading the reply once ctx is canceled.
+	stop := context.AfterFunc(ctx, func() { stream.CancelRead(0) })
+	defer stop()
+
+	framed := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(framed, uint16(len(buf)))
+	copy(framed[2:], buf)
+	if _, err = stream.Write(framed); err != nil {
+		stream.CancelRead(0)
+		return nil, err
+	}
+	// The client MUST send the DNS query over the selected stream, and MUST indicate through the STREAM FIN
+	// mechanism that no further data will be sent on that stream.
+	_ = stream.Close()
+
+	var length [2]byte
+	if _, err = io.ReadFull(stream, length[:]); err != nil {
+		stream.CancelRead(0)
+		return nil, err
+	}
+	content := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err = io.ReadFull(stream, content); err != nil {
+		stream.CancelRead(0)
+		return nil, err
+	}
+
+	r := new(dns.Msg)
+	if err = r.Unpack(content); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
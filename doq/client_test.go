@@ -0,0 +1,172 @@
+package doq
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+func newTestCert(t *testing.T, name string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// serveDoQ serves DoQ queries with an A record 1.2.3.4, and counts accepted connections.
+// Queries of slow.example.com are replied after 300ms.
+func serveDoQ(t *testing.T, ln *quic.Listener, accepted *int32) {
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(accepted, 1)
+		go func() {
+			for {
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				go func() {
+					defer stream.Close()
+					var length [2]byte
+					if _, err := io.ReadFull(stream, length[:]); err != nil {
+						return
+					}
+					buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+					if _, err := io.ReadFull(stream, buf); err != nil {
+						return
+					}
+					req := new(dns.Msg)
+					if err := req.Unpack(buf); err != nil {
+						return
+					}
+					if req.Id != 0 {
+						t.Errorf("DoQ message ID should be 0, got %d", req.Id)
+					}
+					if req.Question[0].Name == "slow.example.com." {
+						time.Sleep(300 * time.Millisecond)
+					}
+					reply := new(dns.Msg)
+					reply.SetReply(req)
+					reply.Answer = append(reply.Answer, &dns.A{
+						Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+						A:   net.ParseIP("1.2.3.4"),
+					})
+					out, _ := reply.Pack()
+					binary.BigEndian.PutUint16(length[:], uint16(len(out)))
+					_, _ = stream.Write(append(length[:], out...))
+				}()
+			}
+		}()
+	}
+}
+
+func TestExchange(t *testing.T) {
+	const name = "dns.test"
+	cert, pool := newTestCert(t, name)
+	ln, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{NextProto},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted int32
+	go serveDoQ(t, ln, &accepted)
+
+	cli := NewClient(WithTimeout(time.Second), WithRootCAs(pool))
+	addr := ln.Addr().String()
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		reply, _, err := cli.Exchange(req, addr, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Id != req.Id || len(reply.Answer) != 1 {
+			t.Errorf("Unexpected reply: %v", reply)
+		}
+	}
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Errorf("Connection should be reused, but %d connections were established", n)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, _, err := cli.Exchange(req, addr, "wrong.test"); err == nil {
+		t.Error("Certificate verification should fail with a wrong server name")
+	}
+}
+
+func TestExchangeTimeoutKeepsConn(t *testing.T) {
+	const name = "dns.test"
+	cert, pool := newTestCert(t, name)
+	ln, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{NextProto},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted int32
+	go serveDoQ(t, ln, &accepted)
+
+	cli := NewClient(WithTimeout(100*time.Millisecond), WithRootCAs(pool))
+	addr := ln.Addr().String()
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, _, err := cli.Exchange(req, addr, name); err != nil {
+		t.Fatal(err)
+	}
+	req.SetQuestion("slow.example.com.", dns.TypeA)
+	if _, _, err := cli.Exchange(req, addr, name); err == nil {
+		t.Fatal("Slow query should time out")
+	}
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, _, err := cli.Exchange(req, addr, name); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Errorf("Connection should be kept after a query times out, but %d connections were established", n)
+	}
+}
@@ -0,0 +1,182 @@
+package dot
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type clientOptions struct {
+	Timeout      time.Duration
+	MaxIdleConns int
+	IdleTimeout  time.Duration
+	RootCAs      *x509.CertPool
+}
+
+type ClientOption func(*clientOptions)
+
+// WithTimeout set a DNS query timeout
+func WithTimeout(t time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.Timeout = t
+	}
+}
+
+// WithMaxIdleConns controls the maximum number of idle connections kept per server.
+func WithMaxIdleConns(n int) ClientOption {
+	return func(o *clientOptions) {
+		o.MaxIdleConns = n
+	}
+}
+
+// WithIdleTimeout controls how long an idle connection is kept before being closed.
+func WithIdleTimeout(t time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.IdleTimeout = t
+	}
+}
+
+// WithRootCAs sets the root certificates to verify servers. System roots are used by default.
+func WithRootCAs(pool *x509.CertPool) ClientOption {
+	return func(o *clientOptions) {
+		o.RootCAs = pool
+	}
+}
+
+type idleConn struct {
+	*dns.Conn
+	since time.Time
+}
+
+// Client is a DNS-over-TLS client (RFC 7858) which reuses connections to the same server.
+// It is safe for concurrent use.
+type Client struct {
+	opt      *clientOptions
+	sessions tls.ClientSessionCache
+
+	mu   sync.Mutex
+	idle map[string][]idleConn
+}
+
+func NewClient(opts ...ClientOption) *Client {
+	o := &clientOptions{
+		MaxIdleConns: 2,
+		IdleTimeout:  10 * time.Second,
+	}
+	for _, f := range opts {
+		f(o)
+	}
+	return &Client{
+		opt:      o,
+		sessions: tls.NewLRUClientSessionCache(0),
+		idle:     make(map[string][]idleConn),
+	}
+}
+
+// Exchange sends a DNS request to address (in ip:port format) over TLS, and verifies the server certificate
+// against serverName. An idle connection to the same server is reused if available.
+func (c *Client) Exchange(req *dns.Msg, address, serverName string) (r *dns.Msg, rtt time.Duration, err error) {
+	return c.ExchangeContext(context.Background(), req, address, serverName)
+}
+
+// ExchangeContext does the same as Exchange, and aborts the request once ctx is done.
+func (c *Client) ExchangeContext(
+	ctx context.Context, req *dns.Msg, address, serverName string,
+) (r *dns.Msg, rtt time.Duration, err error) {
+	begin := time.Now()
+	key := address + "#" + serverName
+	for {
+		conn := c.getConn(key)
+		reused := conn != nil
+		if !reused {
+			if conn, err = c.dial(ctx, address, serverName); err != nil {
+				return
+			}
+		}
+
+		r, err = c.exchange(ctx, conn, req)
+		if err == nil {
+			rtt = time.Since(begin)
+			// the deadline of conn may have been reset on cancellation.
+			if ctx.Err() != nil {
+				conn.Close()
+			} else {
+				c.putConn(key, conn)
+			}
+			return
+		}
+		conn.Close()
+		// The idle connection may have been closed by server. Retry with another one.
+		if !reused || ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (c *Client) dial(ctx context.Context, address, serverName string) (*dns.Conn, error) {
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: c.opt.Timeout},
+		Config: &tls.Config{
+			ServerName:         serverName,
+			RootCAs:            c.opt.RootCAs,
+			ClientSessionCache: c.sessions,
+		},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+func (c *Client) exchange(ctx context.Context, conn *dns.Conn, req *dns.Msg) (*dns.Msg, error) {
+	if c.opt.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(c.opt.Timeout))
+	}
+	// unblock reading and writing once ctx is canceled. The connection is closed by the caller then.
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+	if err := conn.WriteMsg(req); err != nil {
+		return nil, err
+	}
+	r, err := conn.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if r.Id != req.Id {
+		return r, dns.ErrId
+	}
+	return r, nil
+}
+
+func (c *Client) getConn(key string) *dns.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conns := c.idle[key]
+	for len(conns) > 0 {
+		ic := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if time.Since(ic.since) < c.opt.IdleTimeout {
+			c.idle[key] = conns
+			return ic.Conn
+		}
+		ic.Close()
+	}
+	delete(c.idle, key)
+	return nil
+}
+
+func (c *Client) putConn(key string, conn *dns.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle[key]) >= c.opt.MaxIdleConns {
+		conn.Close()
+		return
+	}
+	c.idle[key] = append(c.idle[key], idleConn{Conn: conn, since: time.Now()})
+}
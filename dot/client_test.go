@@ -0,0 +1,108 @@
+package dot
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+func newTestCert(t *testing.T, name string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestExchange(t *testing.T) {
+	const name = "dns.test"
+	cert, pool := newTestCert(t, name)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &countingListener{Listener: ln}
+	server := &dns.Server{
+		Listener: tls.NewListener(cl, &tls.Config{Certificates: []tls.Certificate{cert}}),
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			reply := new(dns.Msg)
+			reply.SetReply(req)
+			reply.Answer = append(reply.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("1.2.3.4"),
+			})
+			_ = w.WriteMsg(reply)
+		}),
+	}
+	go server.ActivateAndServe() //nolint:errcheck
+	defer server.Shutdown()      //nolint:errcheck
+
+	cli := NewClient(WithTimeout(time.Second), WithRootCAs(pool))
+	addr := ln.Addr().String()
+
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		reply, _, err := cli.Exchange(req, addr, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Id != req.Id || len(reply.Answer) != 1 {
+			t.Errorf("Unexpected reply: %v", reply)
+		}
+	}
+	if n := atomic.LoadInt32(&cl.accepted); n != 1 {
+		t.Errorf("Connection should be reused, but %d connections were established", n)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, _, err := cli.Exchange(req, addr, "wrong.test"); err == nil {
+		t.Error("Certificate verification should fail with a wrong server name")
+	}
+}
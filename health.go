@@ -0,0 +1,173 @@
+package gochinadns
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// resolverRanks is a snapshot of trusted and untrusted resolvers in order of preference,
+// without those ejected by health checks.
+type resolverRanks struct {
+	Trusted   resolverList
+	Untrusted resolverList
+}
+
+// resolverStat is the result of testing a resolver with TestDomains.
+type resolverStat struct {
+	Resolver *Resolver
+	Queries  int
+	Errors   int
+	RTT      time.Duration // average RTT of successful queries
+}
+
+// errRate returns the ratio of failed queries, which is 1 if the resolver is not tested at all.
+func (st *resolverStat) errRate() float64 {
+	if st.Queries == 0 {
+		return 1
+	}
+	return float64(st.Errors) / float64(st.Queries)
+}
+
+// healthy reports whether the resolver fails no more than half of the queries.
+func (st *resolverStat) healthy() bool {
+	return st.errRate() <= 0.5
+}
+
+// testResolvers looks up TestDomains in every resolver for loops times concurrently,
+// and returns stats sorted by error rate and average RTT. Queries in flight are aborted and not counted once budget
+// is used up, and 0 means no limit.
+func (s *Server) testResolvers(resolvers resolverList, loops int, budget time.Duration) []resolverStat {
+	ctx := s.ctx
+	if budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, budget)
+		defer cancel()
+	}
+	stats := make([]resolverStat, len(resolvers))
+	var wg sync.WaitGroup
+	for i, rs := range resolvers {
+		wg.Add(1)
+		go func(st *resolverStat, rs *Resolver) {
+			defer wg.Done()
+			st.Resolver = rs
+			var total time.Duration
+		LOOP:
+			for j := 0; j < loops; j++ {
+				for _, name := range s.TestDomains {
+					req := new(dns.Msg)
+					req.SetQuestion(dns.Fqdn(name), dns.TypeA)
+					_, rtt, err := s.LookupContext(ctx, req, rs)
+					if ctx.Err() != nil {
+						break LOOP
+					}
+					st.Queries++
+					if err != nil {
+						st.Errors++
+						continue
+					}
+					total += rtt
+				}
+			}
+			if ok := st.Queries - st.Errors; ok > 0 {
+				st.RTT = total / time.Duration(ok)
+			}
+		}(&stats[i], rs)
+	}
+	wg.Wait()
+
+	sort.SliceStable(stats, func(i, j int) bool {
+		if ri, rj := stats[i].errRate(), stats[j].errRate(); ri != rj {
+			return ri < rj
+		}
+		return stats[i].RTT < stats[j].RTT
+	})
+	return stats
+}
+
+// healthLoops is the times TestDomains are looked up in each resolver per health check, so that a resolver is not
+// ejected by a single lost packet.
+const healthLoops = 3
+
+// CheckHealth tests trusted and untrusted resolvers every HealthInterval until ctx is done or the server is shut down.
+// Resolvers are re-ranked by error rate and average RTT. Those failing more than half of the queries are ejected,
+// and reinstated once they recover in a later check. It returns immediately if HealthInterval is not set.
+// Run calls it while the server is running, so it's only needed if the server is not started by Run.
+func (s *Server) CheckHealth(ctx context.Context) {
+	if s.HealthInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.checkHealth()
+		}
+	}
+}
+
+func (s *Server) checkHealth() {
+	prev := s.ranks.Load()
+	ranks := &resolverRanks{
+		Trusted:   s.rankHealthy(groupTrusted, s.TrustedServers, prev.Trusted),
+		Untrusted: s.rankHealthy(groupUntrusted, s.UntrustedServers, prev.Untrusted),
+	}
+	s.ranks.Store(ranks)
+	logrus.WithFields(logrus.Fields{
+		"trusted":   ranks.Trusted,
+		"untrusted": ranks.Untrusted,
+	}).Debug("Resolvers re-ranked.")
+}
+
+// rankHealthy tests resolvers of the group, and returns the healthy ones in order of preference.
+// If all of them are unhealthy, all are returned so that queries are still attempted. prev is the last ranking,
+// which is used to log ejected and reinstated resolvers.
+func (s *Server) rankHealthy(group string, resolvers, prev resolverList) resolverList {
+	if len(resolvers) == 0 {
+		return nil
+	}
+	stats := s.testResolvers(resolvers, healthLoops, s.HealthInterval)
+	ranked := make(resolverList, 0, len(stats))
+	for _, st := range stats {
+		s.metrics.observeHealth(st.Resolver, st.healthy())
+		if st.healthy() {
+			ranked = append(ranked, st.Resolver)
+		}
+	}
+	if len(ranked) == 0 {
+		logrus.Errorf("All %s resolvers are unhealthy. Keep all of them.", group)
+		for _, st := range stats {
+			ranked = append(ranked, st.Resolver)
+		}
+		return ranked
+	}
+
+	for _, st := range stats {
+		logger := logrus.WithFields(logrus.Fields{"resolver": st.Resolver, "rtt": st.RTT, "errors": st.Errors})
+		switch was := containsResolver(prev, st.Resolver); {
+		case was && !st.healthy():
+			logger.Warn("Resolver is unhealthy. Eject it.")
+		case !was && st.healthy():
+			logger.Info("Resolver recovers. Reinstate it.")
+		}
+	}
+	return ranked
+}
+
+func containsResolver(resolvers resolverList, r *Resolver) bool {
+	for _, rs := range resolvers {
+		if rs == r {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package gochinadns
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// flakyHandler replies to every query unless down is set.
+func flakyHandler(down *atomic.Bool) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		if !down.Load() {
+			answerA(w, req)
+		}
+	}
+}
+
+func TestServerCheckHealth(t *testing.T) {
+	var down1, down2 atomic.Bool
+	addr1, addr2 := startUpstream(t, flakyHandler(&down1)), startUpstream(t, flakyHandler(&down2))
+	s, err := NewServer(NewClient(WithTimeout(100*time.Millisecond)),
+		WithTrustedResolvers(false, "udp@"+addr1, "udp@"+addr2),
+		WithHealthCheck(time.Minute),
+		WithSkipRefineResolvers(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1, r2 := s.TrustedServers[0], s.TrustedServers[1]
+	trusted := func() resolverList { return s.ranks.Load().Trusted }
+
+	down1.Store(true)
+	s.checkHealth()
+	if want := (resolverList{r2}); !reflect.DeepEqual(trusted(), want) {
+		t.Errorf("Failing resolver should be ejected, got %v", trusted())
+	}
+	if servers, _, _ := s.groupServers(groupTrusted); !reflect.DeepEqual(servers, trusted()) {
+		t.Errorf("Trusted group should use ranked resolvers, got %v", servers)
+	}
+
+	down2.Store(true)
+	s.checkHealth()
+	if len(trusted()) != 2 {
+		t.Errorf("All resolvers should be kept if all of them fail, got %v", trusted())
+	}
+
+	down1.Store(false)
+	s.checkHealth()
+	if want := (resolverList{r1}); !reflect.DeepEqual(trusted(), want) {
+		t.Errorf("Recovered resolver should be reinstated, got %v", trusted())
+	}
+
+	down2.Store(false)
+	s.checkHealth()
+	if len(trusted()) != 2 {
+		t.Errorf("All recovered resolvers should be reinstated, got %v", trusted())
+	}
+	if len(s.TrustedServers) != 2 {
+		t.Error("Configured resolvers should not be modified")
+	}
+}
+
+func TestServerCheckHealthPacketLoss(t *testing.T) {
+	var down atomic.Bool
+	s, err := NewServer(NewClient(WithTimeout(100*time.Millisecond)),
+		WithTrustedResolvers(false, "udp@"+startUpstream(t, flakyHandler(&down)), "udp@"+startUpstream(t, flakyHandler(new(atomic.Bool)))),
+		WithHealthCheck(time.Minute),
+		WithSkipRefineResolvers(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the first query of the check is lost.
+	down.Store(true)
+	time.AfterFunc(50*time.Millisecond, func() { down.Store(false) })
+	s.checkHealth()
+	if trusted := s.ranks.Load().Trusted; len(trusted) != 2 {
+		t.Errorf("Resolver should not be ejected by a single lost packet, got %v", trusted)
+	}
+}
+
+func TestServerRefineResolvers(t *testing.T) {
+	var down1, down2 atomic.Bool
+	addr1, addr2 := startUpstream(t, flakyHandler(&down1)), startUpstream(t, flakyHandler(&down2))
+	down1.Store(true)
+
+	start := time.Now()
+	s, err := NewServer(NewClient(WithTimeout(100*time.Millisecond)),
+		WithListenAddr("127.0.0.1:0"),
+		WithTrustedResolvers(false, "udp@"+addr1, "udp@"+addr2),
+		WithRefineTimeout(150*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Refinement should be limited by its timeout, took %s", elapsed)
+	}
+	if len(s.TrustedServers) != 2 || s.TrustedServers[0].GetAddr() != addr2 {
+		t.Errorf("Failing resolver should be refined to the tail, got %v", s.TrustedServers)
+	}
+	if !reflect.DeepEqual(s.ranks.Load().Trusted, s.TrustedServers) {
+		t.Errorf("Refined resolvers should be in use, got %v", s.ranks.Load().Trusted)
+	}
+}
+
+func TestServerRefineResolversAbortInFlight(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	addr1, addr2 := startUpstream(t, flakyHandler(&down)), startUpstream(t, flakyHandler(new(atomic.Bool)))
+
+	start := time.Now()
+	s, err := NewServer(NewClient(WithTimeout(5*time.Second)),
+		WithTrustedResolvers(false, "udp@"+addr1, "udp@"+addr2),
+		WithRefineTimeout(150*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Queries in flight should be aborted once refinement times out, took %s", elapsed)
+	}
+	if s.TrustedServers[0].GetAddr() != addr2 {
+		t.Errorf("Resolver never replying should be refined to the tail, got %v", s.TrustedServers)
+	}
+}
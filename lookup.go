@@ -1,7 +1,9 @@
 package gochinadns
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"time"
 
 	"github.com/miekg/dns"
@@ -9,20 +11,31 @@ import (
 )
 
 // LookupFunc looks up DNS request to the given server and returns DNS reply, its RTT time and an error.
-type LookupFunc func(request *dns.Msg, server *Resolver) (reply *dns.Msg, rtt time.Duration, err error)
+// The lookup is aborted once ctx is done.
+type LookupFunc func(ctx context.Context, request *dns.Msg, server *Resolver) (reply *dns.Msg, rtt time.Duration, err error)
 
 func (c *Client) Lookup(req *dns.Msg, server *Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
+	return c.LookupContext(context.Background(), req, server)
+}
+
+// LookupContext does the same as Lookup, and aborts the lookup once ctx is done, in which case ctx.Err() is returned.
+func (c *Client) LookupContext(ctx context.Context, req *dns.Msg, server *Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
 	if c.Mutation {
-		return c.lookupMutation(req, server)
+		reply, rtt, err = c.lookupMutation(ctx, req, server)
+	} else {
+		reply, rtt, err = c.lookupNormal(ctx, req, server)
 	}
-	return c.lookupNormal(req, server)
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return
 }
 
 // lookupNormal send a DNS request to the specific server and get its corresponding reply.
 // DNS Proxy Implementation Guidelines: https://tools.ietf.org/html/rfc5625
 // DNS query processing: https://tools.ietf.org/html/rfc1034#section-3.7
 // Happy Eyeballs: https://tools.ietf.org/html/rfc6555#section-5.4 and #section-6
-func (c *Client) lookupNormal(req *dns.Msg, server *Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
+func (c *Client) lookupNormal(ctx context.Context, req *dns.Msg, server *Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
 	logger := logrus.WithFields(logrus.Fields{
 		"question": questionString(&req.Question[0]),
 		"server":   server,
@@ -34,9 +47,9 @@ func (c *Client) lookupNormal(req *dns.Msg, server *Resolver) (reply *dns.Msg, r
 		switch protocol {
 		case "udp":
 			logger.Debug("Query upstream udp")
-			reply, rtt0, err = c.UDPCli.Exchange(req, server.GetAddr())
+			reply, rtt0, err = exchangeContext(ctx, c.UDPCli, req, server.GetAddr())
 			rtt += rtt0
-			if err == nil {
+			if err == nil || ctx.Err() != nil {
 				return
 			}
 			logger.WithError(err).Error("Fail to send UDP query.")
@@ -45,19 +58,35 @@ func (c *Client) lookupNormal(req *dns.Msg, server *Resolver) (reply *dns.Msg, r
 			}
 		case "tcp":
 			logger.Debug("Query upstream tcp")
-			reply, rtt0, err = c.TCPCli.Exchange(req, server.GetAddr())
+			reply, rtt0, err = exchangeContext(ctx, c.TCPCli, req, server.GetAddr())
 			rtt += rtt0
-			if err == nil {
+			if err == nil || ctx.Err() != nil {
 				return
 			}
 			logger.WithError(err).Error("Fail to send TCP query.")
 		case "doh":
 			logger.Debug("Query upstream doh")
-			reply, rtt, err = c.DoHCli.Exchange(req, server.GetAddr())
-			if err == nil {
+			reply, rtt, err = c.DoHCli.ExchangeContext(ctx, req, server.GetAddr(), server.GetBootstrap()...)
+			if err == nil || ctx.Err() != nil {
 				return
 			}
 			logger.WithError(err).Error("Fail to send DoH query.")
+		case "dot":
+			logger.Debug("Query upstream dot")
+			reply, rtt0, err = c.DoTCli.ExchangeContext(ctx, req, server.GetAddr(), server.GetServerName())
+			rtt += rtt0
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+			logger.WithError(err).Error("Fail to send DoT query.")
+		case "doq":
+			logger.Debug("Query upstream doq")
+			reply, rtt0, err = c.DoQCli.ExchangeContext(ctx, req, server.GetAddr(), server.GetServerName())
+			rtt += rtt0
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+			logger.WithError(err).Error("Fail to send DoQ query.")
 		default:
 			logger.Errorf("Protocol %s is unsupported in normal method.", protocol)
 			return
@@ -68,7 +97,7 @@ func (c *Client) lookupNormal(req *dns.Msg, server *Resolver) (reply *dns.Msg, r
 
 // lookupMutation does the same as lookupNormal, with pointer mutation for DNS query.
 // DNS Compression: https://tools.ietf.org/html/rfc1035#section-4.1.4
-func (c *Client) lookupMutation(req *dns.Msg, server *Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
+func (c *Client) lookupMutation(ctx context.Context, req *dns.Msg, server *Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
 	logger := logrus.WithFields(logrus.Fields{
 		"question": questionString(&req.Question[0]),
 		"server":   server,
@@ -89,8 +118,8 @@ func (c *Client) lookupMutation(req *dns.Msg, server *Resolver) (reply *dns.Msg,
 			logger.Debug("Query upstream udp")
 			ddl := t.Add(c.UDPCli.Timeout)
 			udpSize := getUDPSize(req)
-			reply, err = rawLookup(c.UDPCli, req.Id, buffer, server, ddl, udpSize)
-			if err == nil {
+			reply, err = rawLookup(ctx, c.UDPCli, req.Id, buffer, server, ddl, udpSize)
+			if err == nil || ctx.Err() != nil {
 				rtt = time.Since(t)
 				return
 			}
@@ -101,19 +130,34 @@ func (c *Client) lookupMutation(req *dns.Msg, server *Resolver) (reply *dns.Msg,
 		case "tcp":
 			logger.Debug("Query upstream tcp")
 			ddl := time.Now().Add(c.TCPCli.Timeout)
-			reply, err = rawLookup(c.TCPCli, req.Id, buffer, server, ddl, 0)
-			if err == nil {
+			reply, err = rawLookup(ctx, c.TCPCli, req.Id, buffer, server, ddl, 0)
+			if err == nil || ctx.Err() != nil {
 				rtt = time.Since(t)
 				return
 			}
 			logger.WithError(err).Error("Fail to send TCP mutation query.")
 		case "doh":
 			logger.Debug("Query upstream doh")
-			reply, rtt, err = c.DoHCli.Exchange(req, server.GetAddr())
-			if err == nil {
+			reply, rtt, err = c.DoHCli.ExchangeContext(ctx, req, server.GetAddr(), server.GetBootstrap()...)
+			if err == nil || ctx.Err() != nil {
 				return
 			}
 			logger.WithError(err).Error("Fail to send DoH query.")
+		case "dot":
+			// Pointer mutation makes no sense in an encrypted channel, so do DoH and DoQ.
+			logger.Debug("Query upstream dot")
+			reply, rtt, err = c.DoTCli.ExchangeContext(ctx, req, server.GetAddr(), server.GetServerName())
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+			logger.WithError(err).Error("Fail to send DoT query.")
+		case "doq":
+			logger.Debug("Query upstream doq")
+			reply, rtt, err = c.DoQCli.ExchangeContext(ctx, req, server.GetAddr(), server.GetServerName())
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+			logger.WithError(err).Error("Fail to send DoQ query.")
 		default:
 			logger.Errorf("Protocol %s is unsupported in mutation method.", protocol)
 			return
@@ -123,13 +167,18 @@ func (c *Client) lookupMutation(req *dns.Msg, server *Resolver) (reply *dns.Msg,
 	return
 }
 
-func rawLookup(cli *dns.Client, id uint16, req []byte, server *Resolver, ddl time.Time, udpSize uint16) (*dns.Msg, error) {
-	conn, err := cli.Dial(server.GetAddr())
+func rawLookup(
+	ctx context.Context, cli *dns.Client, id uint16, req []byte, server *Resolver, ddl time.Time, udpSize uint16,
+) (*dns.Msg, error) {
+	conn, err := dialContext(ctx, cli, server.GetAddr())
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
 	conn.UDPSize = udpSize
+	// unblock reading and writing once ctx is canceled.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
 
 	_ = conn.SetWriteDeadline(ddl)
 	if _, err := conn.Write(req); err != nil {
@@ -147,6 +196,37 @@ func rawLookup(cli *dns.Client, id uint16, req []byte, server *Resolver, ddl tim
 	return reply, err
 }
 
+// exchangeContext does the same as cli.Exchange, and aborts once ctx is done, in which case ctx.Err() is returned.
+func exchangeContext(ctx context.Context, cli *dns.Client, req *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	conn, err := dialContext(ctx, cli, address)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	// unblock reading and writing once ctx is canceled.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	reply, rtt, err := cli.ExchangeWithConn(req, conn)
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return reply, rtt, err
+}
+
+// dialContext does the same as cli.Dial, and aborts once ctx is done.
+func dialContext(ctx context.Context, cli *dns.Client, address string) (*dns.Conn, error) {
+	dialer := net.Dialer{Timeout: cli.Timeout}
+	conn, err := dialer.DialContext(ctx, cli.Net, address)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, err
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
 func setUDPSize(req *dns.Msg, size uint16) uint16 {
 	if size <= dns.MinMsgSize {
 		return dns.MinMsgSize
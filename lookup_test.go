@@ -0,0 +1,78 @@
+package gochinadns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startSilentUpstream starts a UDP and a TCP server which receive queries but never reply, and returns their addresses.
+// They are raw listeners rather than dns.Server, which replies FORMERR to mutated queries.
+func startSilentUpstream(t *testing.T) (udp, tcp string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			if _, _, err := pc.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return pc.LocalAddr().String(), l.Addr().String()
+}
+
+func TestLookupContext(t *testing.T) {
+	udp, tcp := startSilentUpstream(t)
+
+	tests := []struct {
+		resolver string
+		mutation bool
+	}{
+		{"udp@" + udp, false},
+		{"udp@" + udp, true},
+		{"tcp@" + tcp, false},
+		{"tcp@" + tcp, true},
+	}
+	for _, tt := range tests {
+		resolver, err := ParseResolver(tt.resolver, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli := NewClient(WithTimeout(5*time.Second), WithMutation(tt.mutation))
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		start := time.Now()
+		if _, _, err := cli.LookupContext(ctx, req, resolver); !errors.Is(err, context.Canceled) {
+			t.Errorf("Lookup in %s with mutation %v should be canceled, got %v", tt.resolver, tt.mutation, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Lookup in %s with mutation %v should be aborted once canceled, took %s", tt.resolver, tt.mutation, elapsed)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package gochinadns
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "chinadns"
+
+// Branches which a reply may come from.
+const (
+	branchTrusted   = "trusted"   // reply of trusted servers is chosen
+	branchUntrusted = "untrusted" // reply of untrusted servers is chosen
+	branchFallback  = "fallback"  // reply is not preferred but used since no better one is available
+)
+
+// metrics contains Prometheus collectors of a server.
+// All methods are safe to call on a nil *metrics, which means metrics are disabled.
+type metrics struct {
+	registry *prometheus.Registry
+
+	queries       *prometheus.CounterVec
+	servingTime   prometheus.Histogram
+	branches      *prometheus.CounterVec
+	lookupRTT     *prometheus.HistogramVec
+	lookupErrors  *prometheus.CounterVec
+	resolverUp    *prometheus.GaugeVec
+	blacklistHits *prometheus.CounterVec
+	cacheLookups  *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		queries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "queries_total",
+			Help:      "Number of DNS queries received, by query type.",
+		}, []string{"qtype"}),
+		servingTime: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "serving_duration_seconds",
+			Help:      "Time taken to serve a DNS query.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 15),
+		}),
+		branches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "replies_total",
+			Help:      "Number of upstream replies chosen, by the branch which won: trusted, untrusted, fallback or a routed resolver group.",
+		}, []string{"branch"}),
+		lookupRTT: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "resolver_rtt_seconds",
+			Help:      "Round trip time of successful lookups, by upstream resolver.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+		}, []string{"resolver"}),
+		lookupErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "resolver_errors_total",
+			Help:      "Number of failed lookups, by upstream resolver.",
+		}, []string{"resolver"}),
+		resolverUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "resolver_up",
+			Help:      "Whether the upstream resolver passed the last health check (1) or is ejected (0).",
+		}, []string{"resolver"}),
+		blacklistHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "blacklist_hits_total",
+			Help:      "Number of queries or answers hitting blacklists, by list: domain or ip.",
+		}, []string{"list"}),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "cache_lookups_total",
+			Help:      "Number of cache lookups, by result: hit, miss or stale.",
+		}, []string{"result"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.queries, m.servingTime, m.branches, m.lookupRTT, m.lookupErrors, m.resolverUp, m.blacklistHits, m.cacheLookups,
+	)
+	return m
+}
+
+// Handler returns the HTTP handler serving metrics in Prometheus format.
+func (m *metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *metrics) observeQuery(req *dns.Msg, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	qtype, ok := dns.TypeToString[req.Question[0].Qtype]
+	if !ok {
+		qtype = "OTHER"
+	}
+	m.queries.WithLabelValues(qtype).Inc()
+	m.servingTime.Observe(elapsed.Seconds())
+}
+
+func (m *metrics) observeBranch(branch string) {
+	if m == nil {
+		return
+	}
+	m.branches.WithLabelValues(branch).Inc()
+}
+
+func (m *metrics) observeLookup(server *Resolver, rtt time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.lookupErrors.WithLabelValues(server.String()).Inc()
+		return
+	}
+	m.lookupRTT.WithLabelValues(server.String()).Observe(rtt.Seconds())
+}
+
+func (m *metrics) observeHealth(server *Resolver, healthy bool) {
+	if m == nil {
+		return
+	}
+	var up float64
+	if healthy {
+		up = 1
+	}
+	m.resolverUp.WithLabelValues(server.String()).Set(up)
+}
+
+func (m *metrics) observeBlacklist(list string) {
+	if m == nil {
+		return
+	}
+	m.blacklistHits.WithLabelValues(list).Inc()
+}
+
+func (m *metrics) observeCache(result string) {
+	if m == nil {
+		return
+	}
+	m.cacheLookups.WithLabelValues(result).Inc()
+}
@@ -0,0 +1,56 @@
+package gochinadns
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestMetricsNil(t *testing.T) {
+	var m *metrics
+	req := new(dns.Msg)
+	req.SetQuestion("a.com.", dns.TypeA)
+	m.observeQuery(req, time.Millisecond)
+	m.observeBranch(branchTrusted)
+	m.observeLookup(&Resolver{}, time.Millisecond, nil)
+	m.observeBlacklist("ip")
+	m.observeCache("hit")
+}
+
+func TestMetricsHandler(t *testing.T) {
+	m := newMetrics()
+	req := new(dns.Msg)
+	req.SetQuestion("a.com.", dns.TypeAAAA)
+	m.observeQuery(req, time.Millisecond)
+	req.SetQuestion("a.com.", 65000)
+	m.observeQuery(req, time.Millisecond)
+	m.observeBranch(branchFallback)
+	server := &Resolver{Addr: "1.1.1.1:53", Protocols: []string{"udp"}}
+	m.observeLookup(server, 20*time.Millisecond, nil)
+	m.observeLookup(server, 0, errors.New("timeout"))
+	m.observeBlacklist("domain")
+	m.observeCache("miss")
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(w.Body)
+	for _, want := range []string{
+		`chinadns_queries_total{qtype="AAAA"} 1`,
+		`chinadns_queries_total{qtype="OTHER"} 1`,
+		`chinadns_serving_duration_seconds_count 2`,
+		`chinadns_replies_total{branch="fallback"} 1`,
+		`chinadns_resolver_rtt_seconds_count{resolver="udp@1.1.1.1:53"} 1`,
+		`chinadns_resolver_errors_total{resolver="udp@1.1.1.1:53"} 1`,
+		`chinadns_blacklist_hits_total{list="domain"} 1`,
+		`chinadns_cache_lookups_total{result="miss"} 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Metrics should contain %s", want)
+		}
+	}
+}
@@ -24,22 +24,63 @@ type serverOptions struct {
 	IPBlacklist      cidranger.Ranger
 	DomainBlacklist  *domainTrie
 	DomainPolluted   *domainTrie
+	DomainChina      *domainTrie
 	Servers          resolverList  // DNS servers, will be partitioned into TrustedServers and UntrustedServers in bootstrap.
 	TrustedServers   resolverList  // DNS servers which can be trusted
 	UntrustedServers resolverList  // DNS servers which may return polluted results
 	Bidirectional    bool          // Drop results of trusted servers which containing IPs in China
+	ClassifyPolicy   string        // Policy to classify IPs in an answer as in China, one of Policy* policies
+	StripBlacklisted bool          // Strip blacklisted IPs from answers instead of dropping the whole answer
 	ReusePort        bool          // Enable SO_REUSEPORT
 	Delay            time.Duration // Delay (in seconds) to query another DNS server when no reply received
 	TestDomains      []string      // Domain names to test connection health before starting a server
 	SkipRefine       bool
+	RefineTimeout    time.Duration // Time budget to test resolvers before starting a server. 0 means no limit.
+	HealthInterval   time.Duration // Interval to check health of resolvers in background. 0 means disabled.
+	ShutdownTimeout  time.Duration // Max time to wait for in-flight queries when the server is shut down
+	ScoringDisabled  bool          // Disable ordering resolvers by scores learned from live traffic
+	CacheDisabled    bool          // Disable built-in DNS cache
+	CacheEntries     int           // Max DNS cache entries
+	CacheTTL         time.Duration // Fixed TTL of cache entries. 0 means using TTL in DNS answers.
+	LazyExpire       bool          // Whether expired cache entries can be kept until evicted
+	PrefetchHits     int           // Hits of a cache entry to trigger prefetch. 0 means disabled.
+	PrefetchWindow   time.Duration // Prefetch a popular cache entry when its remaining TTL is less than this window
+	NegativeMaxTTL   time.Duration // Max TTL of cached NXDOMAIN and NODATA answers. 0 means disabled.
+	MetricsListen    string        // Listening address of the HTTP server exposing Prometheus metrics at /metrics. Empty means disabled.
+	QueryLog         string        // Path of query log file in JSON lines. Empty means disabled.
+	QueryLogMaxSize  int           // Max size in megabytes of query log file before it gets rotated
+	QueryLogBackups  int           // Max number of rotated query log files to retain. 0 means retaining all.
+	QueryLogMaxAge   int           // Max days to retain rotated query log files. 0 means retaining all.
+	BlockMode        string        // How to reply queries hitting domain blacklist, one of Block* modes
+	BlockTTL         time.Duration // TTL of answers and SOA records in replies to blocked queries
+
+	DomainRoutes   *domainTrie             // Map from domain suffixes to names of resolver groups to query exclusively
+	ResolverGroups map[string]resolverList // Named resolver groups which domains can be routed to, besides trusted and untrusted
+
+	blockIPv4 net.IP // IPv4 answered to blocked A queries in BlockNullIP mode
+	blockIPv6 net.IP // IPv6 answered to blocked AAAA queries in BlockNullIP mode
+
+	listOptions []ServerOption // options loading lists from files, which are applied again on reload
+	listPaths   []string       // paths of list files
 }
 
 func newServerOptions() *serverOptions {
 	return &serverOptions{
-		Listen:      "[::]:53",
-		TestDomains: []string{"qq.com"},
-		ChinaCIDR:   cidranger.NewPCTrieRanger(),
-		IPBlacklist: cidranger.NewPCTrieRanger(),
+		Listen:          "[::]:53",
+		TestDomains:     []string{"qq.com"},
+		RefineTimeout:   10 * time.Second,
+		ShutdownTimeout: 5 * time.Second,
+		ChinaCIDR:       cidranger.NewPCTrieRanger(),
+		IPBlacklist:     cidranger.NewPCTrieRanger(),
+		CacheEntries:    5000,
+		LazyExpire:      true,
+		PrefetchWindow:  10 * time.Second,
+		NegativeMaxTTL:  time.Hour,
+		QueryLogMaxSize: 100,
+		QueryLogBackups: 3,
+		ClassifyPolicy:  PolicyAll,
+		BlockMode:       BlockEmpty,
+		BlockTTL:        time.Minute,
 	}
 }
 
@@ -51,7 +92,7 @@ func WithListenAddr(addr string) ServerOption {
 }
 
 func WithCHNList(path string) ServerOption {
-	return func(o *serverOptions) error {
+	return reloadable(path, func(o *serverOptions) error {
 		if path == "" {
 			return fmt.Errorf("%w for China route list", ErrEmptyPath)
 		}
@@ -80,11 +121,11 @@ func WithCHNList(path string) ServerOption {
 			return fmt.Errorf("fail to scan china route list: %v", err.Error())
 		}
 		return nil
-	}
+	})
 }
 
 func WithIPBlacklist(path string) ServerOption {
-	return func(o *serverOptions) error {
+	return reloadable(path, func(o *serverOptions) error {
 		if path == "" {
 			return fmt.Errorf("%w for IP blacklist", ErrEmptyPath)
 		}
@@ -117,55 +158,126 @@ func WithIPBlacklist(path string) ServerOption {
 			return fmt.Errorf("fail to scan IP blacklist: %v", err.Error())
 		}
 		return nil
-	}
+	})
 }
 
+// WithDomainBlacklist loads domains to block from path. Path can be prefixed by the list format like `adblock:path`,
+// which is one of auto, plain, dnsmasq, gfwlist, hosts and adblock. Format defaults to auto, which detects the format
+// of each line. The same applies to WithDomainPolluted and WithDomainChina.
 func WithDomainBlacklist(path string) ServerOption {
-	return func(o *serverOptions) error {
+	format, path := splitListFormat(path)
+	return reloadable(path, func(o *serverOptions) error {
 		if path == "" {
 			return fmt.Errorf("%w for domain blacklist", ErrEmptyPath)
 		}
-		file, err := os.Open(path)
-		if err != nil {
-			return fmt.Errorf("fail to open domain blacklist: %w", err)
-		}
-		defer file.Close()
-
 		if o.DomainBlacklist == nil {
 			o.DomainBlacklist = new(domainTrie)
 		}
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			o.DomainBlacklist.Add(scanner.Text())
-		}
-		if err := scanner.Err(); err != nil {
-			return fmt.Errorf("fail to scan domain blacklist: %v", err.Error())
+		if err := loadDomainList(path, format, o.DomainBlacklist.Add); err != nil {
+			return fmt.Errorf("fail to load domain blacklist: %w", err)
 		}
 		return nil
-	}
+	})
 }
 
 func WithDomainPolluted(path string) ServerOption {
-	return func(o *serverOptions) error {
+	format, path := splitListFormat(path)
+	return reloadable(path, func(o *serverOptions) error {
 		if path == "" {
 			return fmt.Errorf("%w for polluted domain list", ErrEmptyPath)
 		}
+		if o.DomainPolluted == nil {
+			o.DomainPolluted = new(domainTrie)
+		}
+		if err := loadDomainList(path, format, o.DomainPolluted.Add); err != nil {
+			return fmt.Errorf("fail to load polluted domain list: %w", err)
+		}
+		return nil
+	})
+}
+
+// WithDomainChina loads domains known to be in China from path. Queries of these domains are sent to
+// untrusted servers only, unless they are also in the polluted domain list.
+func WithDomainChina(path string) ServerOption {
+	format, path := splitListFormat(path)
+	return reloadable(path, func(o *serverOptions) error {
+		if path == "" {
+			return fmt.Errorf("%w for China domain list", ErrEmptyPath)
+		}
+		if o.DomainChina == nil {
+			o.DomainChina = new(domainTrie)
+		}
+		if err := loadDomainList(path, format, o.DomainChina.Add); err != nil {
+			return fmt.Errorf("fail to load China domain list: %w", err)
+		}
+		return nil
+	})
+}
+
+// WithDomainRoutes loads rules routing domains to resolver groups from path. Queries of these domains are sent to
+// the resolvers in the group only, bypassing the race between trusted and untrusted resolvers.
+// Each line is either dnsmasq-style `server=/domain[/domain...]/group` or `domain group`, where group is trusted,
+// untrusted, or a group added by WithResolverGroup. Lines starting with # are comments. The longest suffix wins.
+func WithDomainRoutes(path string) ServerOption {
+	return reloadable(path, func(o *serverOptions) error {
+		if path == "" {
+			return fmt.Errorf("%w for domain routes", ErrEmptyPath)
+		}
 		file, err := os.Open(path)
 		if err != nil {
-			return fmt.Errorf("fail to open polluted domain list: %w", err)
+			return fmt.Errorf("fail to open domain routes: %w", err)
 		}
 		defer file.Close()
 
-		if o.DomainPolluted == nil {
-			o.DomainPolluted = new(domainTrie)
+		if o.DomainRoutes == nil {
+			o.DomainRoutes = new(domainTrie)
 		}
 		scanner := bufio.NewScanner(file)
 		for scanner.Scan() {
-			o.DomainPolluted.Add(scanner.Text())
+			domains, group, err := parseDomainRoute(scanner.Text())
+			if err != nil {
+				return err
+			}
+			for _, domain := range domains {
+				o.DomainRoutes.Set(domain, group)
+			}
 		}
 		if err := scanner.Err(); err != nil {
-			return fmt.Errorf("fail to scan polluted domain list: %v", err.Error())
+			return fmt.Errorf("fail to scan domain routes: %v", err.Error())
+		}
+		return nil
+	})
+}
+
+// WithResolverGroup adds a named group of resolvers which domains can be routed to by WithDomainRoutes.
+// Resolvers in groups are not used for other queries. Names trusted and untrusted are reserved.
+func WithResolverGroup(name string, tcpOnly bool, resolvers ...string) ServerOption {
+	return func(o *serverOptions) error {
+		if name == "" || name == groupTrusted || name == groupUntrusted {
+			return fmt.Errorf("invalid resolver group name %q", name)
+		}
+		if o.ResolverGroups == nil {
+			o.ResolverGroups = make(map[string]resolverList)
+		}
+		for _, schema := range resolvers {
+			newResolver, err := ParseResolver(schema, tcpOnly)
+			if err != nil {
+				return err
+			}
+			o.ResolverGroups[name] = uniqueAppendResolver(o.ResolverGroups[name], newResolver)
+		}
+		return nil
+	}
+}
+
+// reloadable marks f as an option loading lists from file path, so that it can be applied again by Server.Reload.
+func reloadable(path string, f ServerOption) ServerOption {
+	return func(o *serverOptions) error {
+		if err := f(o); err != nil {
+			return err
 		}
+		o.listOptions = append(o.listOptions, f)
+		o.listPaths = uniqueAppendString(o.listPaths, path)
 		return nil
 	}
 }
@@ -221,6 +333,27 @@ func WithBidirectional(b bool) ServerOption {
 	}
 }
 
+// WithClassifyPolicy sets the policy to classify all IPs in an answer as in China: all (default), any or majority.
+// An untrusted answer is used only if it's in China, and a trusted one is dropped in bidirectional mode if so.
+func WithClassifyPolicy(policy string) ServerOption {
+	return func(o *serverOptions) error {
+		if err := checkClassifyPolicy(policy); err != nil {
+			return err
+		}
+		o.ClassifyPolicy = policy
+		return nil
+	}
+}
+
+// WithStripBlacklisted strips IPs hitting IP blacklist from answers, and classifies the remaining IPs.
+// An answer is dropped only if all its IPs are blacklisted. By default, an answer is dropped if any IP is blacklisted.
+func WithStripBlacklisted(b bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.StripBlacklisted = b
+		return nil
+	}
+}
+
 func WithReusePort(b bool) ServerOption {
 	return func(o *serverOptions) error {
 		o.ReusePort = b
@@ -248,3 +381,167 @@ func WithSkipRefineResolvers(skip bool) ServerOption {
 		return nil
 	}
 }
+
+// WithRefineTimeout sets the time budget to test resolvers before starting a server. 0 means no limit.
+func WithRefineTimeout(t time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if t < 0 {
+			return fmt.Errorf("invalid refine timeout %s", t)
+		}
+		o.RefineTimeout = t
+		return nil
+	}
+}
+
+// WithShutdownTimeout sets the max time to wait for in-flight queries when Run shuts down the server.
+func WithShutdownTimeout(t time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if t < 0 {
+			return fmt.Errorf("invalid shutdown timeout %s", t)
+		}
+		o.ShutdownTimeout = t
+		return nil
+	}
+}
+
+// WithHealthCheck checks health of trusted and untrusted resolvers every interval while the server is run by Run,
+// re-ranks them and ejects the failing ones until they recover. 0 means disabled.
+func WithHealthCheck(interval time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if interval < 0 {
+			return fmt.Errorf("invalid health check interval %s", interval)
+		}
+		o.HealthInterval = interval
+		return nil
+	}
+}
+
+// WithDisableScoring disables ordering resolvers by exponentially weighted moving averages of RTT and error rate
+// learned from live traffic, so that they are always tried in the refined or specified order.
+func WithDisableScoring(b bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.ScoringDisabled = b
+		return nil
+	}
+}
+
+func WithDisableCache(b bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.CacheDisabled = b
+		return nil
+	}
+}
+
+func WithCacheEntries(n int) ServerOption {
+	return func(o *serverOptions) error {
+		if n < 0 {
+			return fmt.Errorf("invalid cache entries %d", n)
+		}
+		o.CacheEntries = n
+		return nil
+	}
+}
+
+// WithCacheTTL sets a fixed TTL for all cache entries. Set to 0 to use TTL in DNS answers.
+func WithCacheTTL(t time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if t < 0 {
+			return fmt.Errorf("invalid cache TTL %s", t)
+		}
+		o.CacheTTL = t
+		return nil
+	}
+}
+
+// WithLazyExpire keeps expired cache entries until they are evicted.
+func WithLazyExpire(b bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.LazyExpire = b
+		return nil
+	}
+}
+
+// WithPrefetch refreshes a cache entry in background when it has been hit at least `hits` times
+// and its remaining TTL is less than `window`. Set hits to 0 to disable prefetch.
+func WithPrefetch(hits int, window time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if hits < 0 || window < 0 {
+			return fmt.Errorf("invalid prefetch hits %d or window %s", hits, window)
+		}
+		o.PrefetchHits = hits
+		o.PrefetchWindow = window
+		return nil
+	}
+}
+
+// WithNegativeCacheMaxTTL caps the TTL of cached NXDOMAIN and NODATA answers, whose TTL is derived
+// from the SOA record in authority section (RFC 2308). Set to 0 to disable negative caching.
+func WithNegativeCacheMaxTTL(t time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if t < 0 {
+			return fmt.Errorf("invalid negative cache TTL %s", t)
+		}
+		o.NegativeMaxTTL = t
+		return nil
+	}
+}
+
+// WithMetricsListenAddr exposes Prometheus metrics at http://addr/metrics. Set to empty to disable metrics.
+func WithMetricsListenAddr(addr string) ServerOption {
+	return func(o *serverOptions) error {
+		if addr != "" {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return fmt.Errorf("invalid metrics listen address %s: %w", addr, err)
+			}
+		}
+		o.MetricsListen = addr
+		return nil
+	}
+}
+
+// WithQueryLog records every query and how it is answered to path in JSON lines. Set to empty to disable query log.
+func WithQueryLog(path string) ServerOption {
+	return func(o *serverOptions) error {
+		o.QueryLog = path
+		return nil
+	}
+}
+
+// WithQueryLogRotation rotates query log when it grows larger than maxSize megabytes,
+// and retains at most maxBackups rotated files for at most maxAge days. 0 means retaining all.
+func WithQueryLogRotation(maxSize, maxBackups, maxAge int) ServerOption {
+	return func(o *serverOptions) error {
+		if maxSize <= 0 || maxBackups < 0 || maxAge < 0 {
+			return fmt.Errorf("invalid query log rotation max size %d, max backups %d or max age %d", maxSize, maxBackups, maxAge)
+		}
+		o.QueryLogMaxSize = maxSize
+		o.QueryLogBackups = maxBackups
+		o.QueryLogMaxAge = maxAge
+		return nil
+	}
+}
+
+// WithBlockMode sets how to reply queries hitting domain blacklist. Mode is one of empty (default), nxdomain,
+// refused, nodata and null, or comma separated sinkhole IPs like `10.0.0.1,fd00::1` answered to A and AAAA queries.
+// Negative replies of nxdomain, nodata, null and sinkhole modes carry an SOA record.
+func WithBlockMode(mode string) ServerOption {
+	return func(o *serverOptions) error {
+		kind, ipv4, ipv6, err := parseBlockMode(mode)
+		if err != nil {
+			return err
+		}
+		o.BlockMode, o.blockIPv4, o.blockIPv6 = kind, ipv4, ipv6
+		return nil
+	}
+}
+
+// WithBlockTTL sets TTL of answers and SOA records in replies to queries hitting domain blacklist.
+func WithBlockTTL(t time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if t < 0 {
+			return fmt.Errorf("invalid block TTL %s", t)
+		}
+		o.BlockTTL = t
+		return nil
+	}
+}
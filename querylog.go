@@ -0,0 +1,142 @@
+package gochinadns
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Sources which a reply may come from.
+const (
+	sourceBlacklist = "blacklist" // query hits domain blacklist
+	sourceCache     = "cache"
+	sourceStale     = "stale"    // stale cache entry served since no upstream reply
+	sourceUpstream  = "upstream" // reply is resolved upstream, or shared with an identical in-flight query
+	sourceNone      = "none"     // no reply available, an empty reply is served
+)
+
+// queryTrace records how a query is resolved in upstream resolvers.
+type queryTrace struct {
+	Resolver    *Resolver // resolver whose reply is chosen
+	Branch      string    // branch which won: trusted, untrusted, fallback or a routed resolver group
+	Blacklisted []net.IP  // answers hitting IP blacklist, whose replies are dropped
+}
+
+func (t *queryTrace) addBlacklisted(ip net.IP) {
+	t.Blacklisted = append(t.Blacklisted, ip)
+}
+
+// queryLogEntry is a line of the query log.
+type queryLogEntry struct {
+	Time        time.Time `json:"time"`
+	Client      string    `json:"client"`
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Source      string    `json:"source"`
+	Resolver    string    `json:"resolver,omitempty"`
+	Branch      string    `json:"branch,omitempty"`
+	Rcode       string    `json:"rcode"`
+	Answers     []string  `json:"answers,omitempty"`
+	China       []string  `json:"china,omitempty"`    // answers belonging to China
+	Overseas    []string  `json:"overseas,omitempty"` // answers not belonging to China
+	Blacklisted []string  `json:"blacklisted,omitempty"`
+	LatencyMs   float64   `json:"latency_ms"`
+}
+
+// queryLog writes queries in JSON lines.
+// All methods are safe to call on a nil *queryLog, which means query log is disabled.
+type queryLog struct {
+	mu  sync.Mutex
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+// newQueryLog creates a query log writing to path, which is rotated when it grows larger than maxSize megabytes.
+// At most maxBackups old files are retained for at most maxAge days. 0 means retaining all.
+func newQueryLog(path string, maxSize, maxBackups, maxAge int) *queryLog {
+	w := &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+		MaxAge:     maxAge,
+		LocalTime:  true,
+	}
+	return &queryLog{w: w, enc: json.NewEncoder(w)}
+}
+
+func (l *queryLog) Write(entry *queryLogEntry) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(entry); err != nil {
+		logrus.WithError(err).Error("Fail to write query log.")
+	}
+}
+
+func (l *queryLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Close()
+}
+
+// logQuery writes a query and the reply served to the query log.
+func (s *Server) logQuery(client net.Addr, req, reply *dns.Msg, source string, trace *queryTrace, elapsed time.Duration) {
+	if s.queryLog == nil {
+		return
+	}
+	q := req.Question[0]
+	entry := &queryLogEntry{
+		Time:      time.Now(),
+		Name:      q.Name,
+		Type:      dns.Type(q.Qtype).String(),
+		Source:    source,
+		Rcode:     dns.RcodeToString[reply.Rcode],
+		LatencyMs: float64(elapsed.Microseconds()) / 1000,
+	}
+	if client != nil {
+		entry.Client = client.String()
+	}
+	if trace != nil {
+		if trace.Resolver != nil {
+			entry.Resolver = trace.Resolver.String()
+		}
+		entry.Branch = trace.Branch
+		for _, ip := range trace.Blacklisted {
+			entry.Blacklisted = append(entry.Blacklisted, ip.String())
+		}
+	}
+
+	rules := s.rules.Load()
+	for _, rr := range reply.Answer {
+		var ip net.IP
+		switch answer := rr.(type) {
+		case *dns.A:
+			ip = answer.A
+		case *dns.AAAA:
+			ip = answer.AAAA
+		case *dns.CNAME:
+			entry.Answers = append(entry.Answers, answer.Target)
+			continue
+		default:
+			continue
+		}
+		entry.Answers = append(entry.Answers, ip.String())
+		if contain, _ := rules.ChinaCIDR.Contains(ip); contain {
+			entry.China = append(entry.China, ip.String())
+		} else {
+			entry.Overseas = append(entry.Overseas, ip.String())
+		}
+	}
+	s.queryLog.Write(entry)
+}
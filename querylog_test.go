@@ -0,0 +1,70 @@
+package gochinadns
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestQueryLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	chn := filepath.Join(t.TempDir(), "china.list")
+	if err := os.WriteFile(chn, []byte("1.2.3.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(NewClient(), WithCHNList(chn), WithQueryLog(path), WithSkipRefineResolvers(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply := newTestReply("a.com", 60)
+	reply.Answer = append(reply.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "a.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("8.8.8.8"),
+	})
+	req := new(dns.Msg)
+	req.SetQuestion("a.com.", dns.TypeA)
+	trace := &queryTrace{
+		Resolver:    &Resolver{Addr: "1.1.1.1:53", Protocols: []string{"udp"}},
+		Branch:      branchFallback,
+		Blacklisted: []net.IP{net.ParseIP("4.3.2.1")},
+	}
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}
+	s.logQuery(client, req, reply, sourceUpstream, trace, 1500*time.Microsecond)
+	if err := s.queryLog.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry queryLogEntry
+	if err := json.Unmarshal(content, &entry); err != nil {
+		t.Fatal(err)
+	}
+	entry.Time = time.Time{}
+	want := queryLogEntry{
+		Client:      "127.0.0.1:5353",
+		Name:        "a.com.",
+		Type:        "A",
+		Source:      sourceUpstream,
+		Resolver:    "udp@1.1.1.1:53",
+		Branch:      branchFallback,
+		Rcode:       "NOERROR",
+		Answers:     []string{"1.2.3.4", "8.8.8.8"},
+		China:       []string{"1.2.3.4"},
+		Overseas:    []string{"8.8.8.8"},
+		Blacklisted: []string{"4.3.2.1"},
+		LatencyMs:   1.5,
+	}
+	if !reflect.DeepEqual(entry, want) {
+		t.Errorf("Query log entry should be %+v, got %+v", want, entry)
+	}
+}
@@ -0,0 +1,104 @@
+package gochinadns
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/yl2chen/cidranger"
+)
+
+// ruleLists contains the lists used in serving, which can be swapped atomically on reload.
+type ruleLists struct {
+	ChinaCIDR       cidranger.Ranger
+	IPBlacklist     cidranger.Ranger
+	DomainBlacklist *domainTrie
+	DomainPolluted  *domainTrie
+	DomainChina     *domainTrie
+	DomainRoutes    *domainTrie
+}
+
+func newRuleLists(o *serverOptions) *ruleLists {
+	return &ruleLists{
+		ChinaCIDR:       o.ChinaCIDR,
+		IPBlacklist:     o.IPBlacklist,
+		DomainBlacklist: o.DomainBlacklist,
+		DomainPolluted:  o.DomainPolluted,
+		DomainChina:     o.DomainChina,
+		DomainRoutes:    o.DomainRoutes,
+	}
+}
+
+// Reload loads China route list, IP blacklist and domain lists from files again, and swaps them atomically.
+// In-flight queries keep using the old lists. If any list fails to load, the old lists are kept.
+// Cached replies are flushed once new lists are loaded, since they are chosen by the old ones.
+// Note that resolvers are not partitioned again.
+func (s *Server) Reload() error {
+	o := newServerOptions()
+	for _, f := range s.listOptions {
+		if err := f(o); err != nil {
+			return fmt.Errorf("fail to reload lists: %w", err)
+		}
+	}
+	if err := s.checkDomainRoutes(o.DomainRoutes); err != nil {
+		return fmt.Errorf("fail to reload lists: %w", err)
+	}
+	s.rules.Store(newRuleLists(o))
+	s.cache.Flush()
+	logrus.Info("Lists reloaded.")
+	return nil
+}
+
+// WatchLists watches list files and reloads them on change until ctx is done.
+// Changes in a short period are merged into one reload.
+func (s *Server) WatchLists(ctx context.Context) error {
+	const debounce = time.Second
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// Watch directories instead of files, so that files replaced by rename are still tracked.
+	files := make(map[string]bool)
+	for _, path := range s.listPaths {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		files[path] = true
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			return fmt.Errorf("fail to watch %s: %w", path, err)
+		}
+	}
+
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if files[filepath.Clean(event.Name)] && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				logrus.Debugf("List file %s changed.", event.Name)
+				timer.Reset(debounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			logrus.WithError(err).Error("List watcher error.")
+		case <-timer.C:
+			if err := s.Reload(); err != nil {
+				logrus.WithError(err).Error("Fail to reload lists.")
+			}
+		}
+	}
+}
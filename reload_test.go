@@ -0,0 +1,103 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestServerReload(t *testing.T) {
+	dir := t.TempDir()
+	blacklist := filepath.Join(dir, "blacklist.txt")
+	if err := os.WriteFile(blacklist, []byte("a.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewServer(NewClient(), WithDomainBlacklist(blacklist), WithSkipRefineResolvers(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := s.rules.Load()
+	if !rules.DomainBlacklist.Contain("a.com") || rules.DomainBlacklist.Contain("b.com") {
+		t.Fatal("Domain blacklist should contain a.com only")
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("c.com.", dns.TypeA)
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.Answer = append(reply.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "c.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("1.1.1.1"),
+	})
+	s.cache.Set(cacheKey(req), reply)
+	if s.cache.Len() != 1 {
+		t.Fatal("Reply should be cached")
+	}
+
+	if err := os.WriteFile(blacklist, []byte("b.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if s.cache.Len() != 0 || s.cache.GetStale(cacheKey(req)) != nil {
+		t.Error("Cached replies should be flushed on reload")
+	}
+	if !rules.DomainBlacklist.Contain("a.com") {
+		t.Error("Lists in use should not be modified by reload")
+	}
+	rules = s.rules.Load()
+	if rules.DomainBlacklist.Contain("a.com") || !rules.DomainBlacklist.Contain("b.com") {
+		t.Error("Domain blacklist should contain b.com only after reload")
+	}
+
+	if err := os.Remove(blacklist); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Error("Reload should fail when a list is missing")
+	}
+	if s.rules.Load() != rules {
+		t.Error("Old lists should be kept when reload fails")
+	}
+}
+
+func TestServerWatchLists(t *testing.T) {
+	dir := t.TempDir()
+	blacklist := filepath.Join(dir, "blacklist.txt")
+	if err := os.WriteFile(blacklist, []byte("a.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(NewClient(), WithDomainBlacklist(blacklist), WithSkipRefineResolvers(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.WatchLists(ctx)
+	time.Sleep(100 * time.Millisecond)
+
+	// replace the file by rename, as editors usually do.
+	tmp := filepath.Join(dir, "blacklist.tmp")
+	if err := os.WriteFile(tmp, []byte("b.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, blacklist); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.rules.Load().DomainBlacklist.Contain("b.com") {
+		if time.Now().After(deadline) {
+			t.Fatal("Lists should be reloaded after the file is changed")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,86 @@
+package gochinadns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Reserved resolver groups which domains can be routed to.
+const (
+	groupTrusted   = "trusted"
+	groupUntrusted = "untrusted"
+)
+
+// parseDomainRoute parses a line of domain routes in format `server=/domain[/domain...]/group` or `domain group`.
+// It returns no domains for empty lines and comments.
+func parseDomainRoute(line string) (domains []string, group string, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+	if rule := strings.TrimPrefix(line, "server="); rule != line {
+		fields := strings.Split(strings.TrimPrefix(rule, "/"), "/")
+		if len(fields) < 2 {
+			return nil, "", fmt.Errorf("invalid domain route %q", line)
+		}
+		domains, group = fields[:len(fields)-1], fields[len(fields)-1]
+	} else {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, "", fmt.Errorf("invalid domain route %q", line)
+		}
+		domains, group = fields[:1], fields[1]
+	}
+	if group == "" {
+		return nil, "", fmt.Errorf("invalid domain route %q: empty resolver group", line)
+	}
+	return
+}
+
+// checkDomainRoutes checks if every group which domains are routed to exists.
+func (s *Server) checkDomainRoutes(routes *domainTrie) error {
+	for _, group := range routes.Values() {
+		if _, _, ok := s.groupServers(group); !ok {
+			return fmt.Errorf("domains are routed to unknown resolver group %s", group)
+		}
+	}
+	return nil
+}
+
+// groupServers returns resolvers in the group, and the function to look up in them.
+func (s *Server) groupServers(group string) (servers resolverList, lookup LookupFunc, ok bool) {
+	switch group {
+	case groupTrusted:
+		return s.ranks.Load().Trusted, s.LookupContext, true
+	case groupUntrusted:
+		return s.ranks.Load().Untrusted, s.lookupNormal, true
+	}
+	servers, ok = s.ResolverGroups[group]
+	return servers, s.lookupNormal, ok
+}
+
+// resolveInGroup looks up the request in resolvers of the group only, and returns the first reply.
+// It returns nil if no reply is available.
+func (s *Server) resolveInGroup(req *dns.Msg, logger *logrus.Entry, trace *queryTrace, group string) *dns.Msg {
+	servers, lookup, _ := s.groupServers(group)
+	logger.Debug("Domain is routed to resolver group ", group)
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	result := make(chan *upstreamReply, 1)
+	go s.lookupInServers(ctx, cancel, result, req, servers, s.Delay, lookup)
+
+	// lookupInServers is done once a reply is sent or all resolvers fail.
+	<-ctx.Done()
+	select {
+	case reply := <-result:
+		trace.Resolver, trace.Branch = reply.Server, group
+		s.metrics.observeBranch(group)
+		return reply.Msg
+	default:
+		return nil
+	}
+}
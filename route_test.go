@@ -0,0 +1,200 @@
+package gochinadns
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseDomainRoute(t *testing.T) {
+	tests := []struct {
+		line    string
+		domains []string
+		group   string
+		err     bool
+	}{
+		{line: ""},
+		{line: "  # comment"},
+		{line: "server=/corp.example.com/corp", domains: []string{"corp.example.com"}, group: "corp"},
+		{line: "server=/a.cn/b.cn/untrusted", domains: []string{"a.cn", "b.cn"}, group: "untrusted"},
+		{line: "google.com  trusted", domains: []string{"google.com"}, group: "trusted"},
+		{line: "server=/corp.example.com/", err: true},
+		{line: "server=corp", err: true},
+		{line: "google.com", err: true},
+	}
+	for _, tt := range tests {
+		domains, group, err := parseDomainRoute(tt.line)
+		if (err != nil) != tt.err {
+			t.Errorf("parseDomainRoute(%q) error = %v, want error %v", tt.line, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(domains, tt.domains) || group != tt.group {
+			t.Errorf("parseDomainRoute(%q) = %v, %q, want %v, %q", tt.line, domains, group, tt.domains, tt.group)
+		}
+	}
+}
+
+// startUpstream starts a UDP DNS server serving queries by handler, and returns its address.
+func startUpstream(t *testing.T, handler dns.HandlerFunc) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &dns.Server{PacketConn: pc, Handler: handler}
+	go upstream.ActivateAndServe()            //nolint:errcheck
+	t.Cleanup(func() { upstream.Shutdown() }) //nolint:errcheck
+	return pc.LocalAddr().String()
+}
+
+// answerA replies req with A records of answers.
+func answerA(w dns.ResponseWriter, req *dns.Msg, answers ...string) {
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	for _, answer := range answers {
+		reply.Answer = append(reply.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(answer),
+		})
+	}
+	_ = w.WriteMsg(reply)
+}
+
+// answerHandler answers answers to every A query.
+func answerHandler(answers ...string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) { answerA(w, req, answers...) }
+}
+
+func TestServerDomainRoutes(t *testing.T) {
+	addr := startUpstream(t, answerHandler("10.0.0.1"))
+	routes := filepath.Join(t.TempDir(), "routes.txt")
+	if err := os.WriteFile(routes, []byte("server=/corp.example/corp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(NewClient(WithTimeout(time.Second)),
+		WithResolverGroup("corp", false, addr),
+		WithDomainRoutes(routes),
+		WithDelay(100*time.Millisecond),
+		WithSkipRefineResolvers(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.corp.example.", dns.TypeA)
+	trace := new(queryTrace)
+	reply := s.resolve(req, logrus.NewEntry(logrus.StandardLogger()), trace)
+	if reply == nil || len(reply.Answer) != 1 {
+		t.Fatalf("Routed domain should be resolved by the group, got %v", reply)
+	}
+	if trace.Branch != "corp" || trace.Resolver.GetAddr() != addr {
+		t.Errorf("Reply should come from group corp, got %s from %s", trace.Branch, trace.Resolver)
+	}
+
+	req.SetQuestion("www.example.", dns.TypeA)
+	if reply := s.resolve(req, logrus.NewEntry(logrus.StandardLogger()), new(queryTrace)); reply != nil {
+		t.Error("Domain not routed should not be resolved by the group")
+	}
+
+	if err := os.WriteFile(routes, []byte("server=/corp.example/unknown\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Error("Routes to unknown group should fail to reload")
+	}
+	if _, err := NewServer(NewClient(), WithDomainRoutes(routes), WithSkipRefineResolvers(true)); err == nil {
+		t.Error("Routes to unknown group should fail to create server")
+	}
+}
+
+func TestServerDomainRoutesBuiltinGroups(t *testing.T) {
+	dir := t.TempDir()
+	chnList := filepath.Join(dir, "china.list")
+	routes := filepath.Join(dir, "routes.txt")
+	for path, content := range map[string]string{
+		chnList: "127.0.0.1/32\n",
+		routes:  "server=/cn/untrusted\nexample.com trusted\n",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	untrusted := startUpstream(t, answerHandler("1.1.1.1"))
+	trusted := startUpstream(t, answerHandler("2.2.2.2"))
+	s, err := NewServer(NewClient(WithTimeout(time.Second)),
+		WithCHNList(chnList),
+		WithDomainRoutes(routes),
+		WithResolvers(false, untrusted),
+		WithTrustedResolvers(false, trusted),
+		WithDelay(time.Second),
+		WithSkipRefineResolvers(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"www.qq.cn.":       groupUntrusted,
+		"www.example.com.": groupTrusted,
+	}
+	for name, group := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		trace := new(queryTrace)
+		if reply := s.resolve(req, logrus.NewEntry(logrus.StandardLogger()), trace); reply == nil {
+			t.Fatalf("%s should be resolved", name)
+		}
+		if trace.Branch != group {
+			t.Errorf("%s should be resolved by group %s, got %s", name, group, trace.Branch)
+		}
+	}
+}
+
+func TestServerDomainChina(t *testing.T) {
+	dir := t.TempDir()
+	chnList := filepath.Join(dir, "china.list")
+	domains := filepath.Join(dir, "china-domains.txt")
+	polluted := filepath.Join(dir, "polluted.txt")
+	for path, content := range map[string]string{
+		chnList:  "127.0.0.1/32\n",
+		domains:  "cn\n",
+		polluted: "polluted.cn\n",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	untrusted := startUpstream(t, answerHandler("1.1.1.1"))
+	trusted := startUpstream(t, answerHandler("2.2.2.2"))
+	s, err := NewServer(NewClient(WithTimeout(time.Second)),
+		WithCHNList(chnList),
+		WithDomainChina(domains),
+		WithDomainPolluted(polluted),
+		WithResolvers(false, untrusted),
+		WithTrustedResolvers(false, trusted),
+		WithDelay(time.Second),
+		WithSkipRefineResolvers(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"www.qq.cn.":       branchUntrusted,
+		"www.polluted.cn.": branchTrusted,
+	}
+	for name, branch := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		trace := new(queryTrace)
+		if reply := s.resolve(req, logrus.NewEntry(logrus.StandardLogger()), trace); reply == nil {
+			t.Fatalf("%s should be resolved", name)
+		}
+		if trace.Branch != branch {
+			t.Errorf("%s should be resolved by %s servers, got %s", name, branch, trace.Branch)
+		}
+	}
+}
@@ -9,7 +9,7 @@ import (
 )
 
 var (
-	supportedProtocols   = []string{"udp", "tcp", "doh"}
+	supportedProtocols   = []string{"udp", "tcp", "doh", "dot", "doq"}
 	supportedProtocolMap = make(map[string]bool)
 
 	ErrUnknowProtocol  = errors.New("unknown protocol")
@@ -28,8 +28,10 @@ func SupportedProtocols() []string {
 
 // Resolver contains info about a single upstream DNS server.
 type Resolver struct {
-	Addr      string   //address of the resolver in format ip:port
-	Protocols []string //list of protocols to use with this resolver, in order of execution
+	Addr       string   //address of the resolver in format ip:port
+	Protocols  []string //list of protocols to use with this resolver, in order of execution
+	ServerName string   //name to verify the TLS certificate of the resolver, used by DoT and DoQ
+	Bootstrap  []string //IPs to connect a DoH resolver directly, without resolving its host
 }
 
 func (r *Resolver) GetAddr() string {
@@ -40,11 +42,26 @@ func (r *Resolver) GetProtocols() []string {
 	return r.Protocols
 }
 
+func (r *Resolver) GetServerName() string {
+	return r.ServerName
+}
+
+func (r *Resolver) GetBootstrap() []string {
+	return r.Bootstrap
+}
+
 func (r *Resolver) String() string {
 	sb := new(strings.Builder)
 	sb.WriteString(strings.Join(r.Protocols, "+"))
 	sb.WriteByte('@')
 	sb.WriteString(r.Addr)
+	if r.ServerName != "" {
+		sb.WriteByte('#')
+		sb.WriteString(r.ServerName)
+	} else if len(r.Bootstrap) > 0 {
+		sb.WriteByte('#')
+		sb.WriteString(strings.Join(r.Bootstrap, ","))
+	}
 	return sb.String()
 }
 
@@ -62,12 +79,17 @@ func (r resolverList) String() string {
 
 // ParseResolver takes a single resolver in schema string format and outputs a resolver struct.
 // It also accept regular ip[:port] format for backwards compatibility.
-// The schema is defined as:  [protocol[+protocol]@]host[:port][/endpoint]
+// The schema is defined as:  [protocol[+protocol]@]host[:port][/endpoint][#servername|#ip[,ip]]
+// where servername is used to verify the TLS certificate of a DoT or DoQ resolver, defaults to host;
+// and ips are bootstrap addresses of a DoH resolver, e.g. doh@https://dns.google/dns-query#8.8.8.8,8.8.4.4
 func ParseResolver(schema string, tcpOnly bool) (r *Resolver, err error) {
 	err = nil
 	var (
-		addr   string
-		protos []string
+		addr       string
+		protos     []string
+		fragment   string
+		serverName string
+		bootstrap  []string
 	)
 	fields := strings.Split(schema, "@")
 	if len(fields) == 1 { // schema in ip[:port] format
@@ -87,6 +109,10 @@ func ParseResolver(schema string, tcpOnly bool) (r *Resolver, err error) {
 		}
 	}
 
+	if i := strings.LastIndexByte(addr, '#'); i >= 0 {
+		addr, fragment = addr[:i], addr[i+1:]
+	}
+
 	// Process host port
 	if _, _, err = net.SplitHostPort(addr); err != nil {
 		if strings.Contains(err.Error(), "missing port in address") ||
@@ -94,7 +120,11 @@ func ParseResolver(schema string, tcpOnly bool) (r *Resolver, err error) {
 			if strings.Contains(addr, "[") {
 				return
 			}
-			addr, err = net.JoinHostPort(addr, "53"), nil
+			var port string
+			if port, err = defaultPort(schema, protos); err != nil {
+				return
+			}
+			addr = net.JoinHostPort(addr, port)
 		} else {
 			return
 		}
@@ -107,9 +137,35 @@ func ParseResolver(schema string, tcpOnly bool) (r *Resolver, err error) {
 		}
 	}
 
+	var useTLS, useDoH bool
+	for _, protocol := range protos {
+		useTLS = useTLS || isTLSProtocol(protocol)
+		useDoH = useDoH || protocol == "doh"
+	}
+	switch {
+	case useTLS:
+		if serverName = fragment; serverName == "" {
+			serverName, _, _ = net.SplitHostPort(addr)
+		}
+	case useDoH && fragment != "":
+		for _, ip := range strings.Split(fragment, ",") {
+			ip = strings.Trim(strings.TrimSpace(ip), "[]")
+			if net.ParseIP(ip) == nil {
+				err = fmt.Errorf("%w [%s]: invalid bootstrap IP %s", ErrInvalidResolver, schema, ip)
+				return
+			}
+			bootstrap = uniqueAppendString(bootstrap, ip)
+		}
+	case fragment != "":
+		err = fmt.Errorf("%w [%s]: only dot, doq and doh support the # suffix", ErrInvalidResolver, schema)
+		return
+	}
+
 	r = &Resolver{
-		Addr:      addr,
-		Protocols: protos,
+		Addr:       addr,
+		Protocols:  protos,
+		ServerName: serverName,
+		Bootstrap:  bootstrap,
 	}
 	return
 }
@@ -121,8 +177,8 @@ func checkProtocolHost(proto, addr string) error {
 	}
 	var errInvalid = fmt.Errorf("%w [%s@%s]", ErrInvalidResolver, proto, addr)
 	switch proto {
-	case "udp", "tcp":
-		// Only IP format is allowd for UDP and TCP DNS protocol
+	case "udp", "tcp", "dot", "doq":
+		// Only IP format is allowd for UDP, TCP, DoT and DoQ DNS protocol
 		host, _, err := net.SplitHostPort(addr)
 		if err != nil {
 			return err
@@ -141,3 +197,28 @@ func checkProtocolHost(proto, addr string) error {
 	}
 	return nil
 }
+
+// isTLSProtocol reports whether proto is a TLS based protocol whose resolver is in ip:port format.
+func isTLSProtocol(proto string) bool {
+	return proto == "dot" || proto == "doq"
+}
+
+// defaultPort returns the default port of protocols, which is 853 for dot and doq, and 53 for udp and tcp.
+// Mixing them has no default port.
+func defaultPort(schema string, protos []string) (string, error) {
+	var tls, plain bool
+	for _, protocol := range protos {
+		if isTLSProtocol(protocol) {
+			tls = true
+		} else {
+			plain = true
+		}
+	}
+	switch {
+	case tls && plain:
+		return "", fmt.Errorf("%w [%s]: port is required when mixing TLS and plain protocols", ErrInvalidResolver, schema)
+	case tls:
+		return "853", nil
+	}
+	return "53", nil
+}
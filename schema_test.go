@@ -55,6 +55,47 @@ func Test_schemaToResolver(t *testing.T) {
 		{"doh+udp@https://doh.serv/query", nil, true},
 		{"https://doh.serv/query", nil, true},
 		{"udp@https://doh.serv/query", nil, true},
+		{"dot@1.1.1.1#cloudflare-dns.com", &Resolver{
+			Addr:       "1.1.1.1:853",
+			Protocols:  []string{"dot"},
+			ServerName: "cloudflare-dns.com",
+		}, false},
+		{"dot@1.1.1.1:8853", &Resolver{
+			Addr:       "1.1.1.1:8853",
+			Protocols:  []string{"dot"},
+			ServerName: "1.1.1.1",
+		}, false},
+		{"dot@[2606:4700::1111]#cloudflare-dns.com", nil, true},
+		{"dot+doq@1.1.1.1#cloudflare-dns.com", &Resolver{
+			Addr:       "1.1.1.1:853",
+			Protocols:  []string{"dot", "doq"},
+			ServerName: "cloudflare-dns.com",
+		}, false},
+		{"udp+dot@1.1.1.1", nil, true},
+		{"udp+dot@1.1.1.1:853", &Resolver{
+			Addr:       "1.1.1.1:853",
+			Protocols:  []string{"udp", "dot"},
+			ServerName: "1.1.1.1",
+		}, false},
+		{"dot@2606:4700::1111#cloudflare-dns.com", &Resolver{
+			Addr:       "[2606:4700::1111]:853",
+			Protocols:  []string{"dot"},
+			ServerName: "cloudflare-dns.com",
+		}, false},
+		{"dot@cloudflare-dns.com", nil, true},
+		{"udp@1.1.1.1#cloudflare-dns.com", nil, true},
+		{"doq@94.140.14.140#dns-unfiltered.adguard.com", &Resolver{
+			Addr:       "94.140.14.140:853",
+			Protocols:  []string{"doq"},
+			ServerName: "dns-unfiltered.adguard.com",
+		}, false},
+		{"doq@dns.adguard.com:853", nil, true},
+		{"doh@https://dns.google/dns-query#8.8.8.8,2001:4860:4860::8888", &Resolver{
+			Addr:      "https://dns.google/dns-query",
+			Protocols: []string{"doh"},
+			Bootstrap: []string{"8.8.8.8", "2001:4860:4860::8888"},
+		}, false},
+		{"doh@https://dns.google/dns-query#dns.google", nil, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
@@ -0,0 +1,129 @@
+package gochinadns
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// scoreWeight is the weight of a new observation in the exponentially weighted moving averages of resolver scores.
+const scoreWeight = 0.2
+
+// defaultErrorPenalty is the cost of a failed lookup if the client has no timeout.
+const defaultErrorPenalty = 2 * time.Second
+
+// resolverScore is the exponentially weighted moving averages of RTT and error rate of a resolver.
+type resolverScore struct {
+	RTT     float64 // in seconds, of successful lookups
+	ErrRate float64 // between 0 and 1
+	rttSeen bool    // whether RTT has been observed
+}
+
+// resolverScores learns scores of resolvers from lookups of live traffic, and orders resolvers by them.
+// All methods are safe for concurrent use, and safe to call on a nil *resolverScores, which means scoring is disabled.
+type resolverScores struct {
+	mu      sync.RWMutex
+	scores  map[*Resolver]*resolverScore
+	penalty float64 // cost in seconds of a failed lookup
+}
+
+func newResolverScores(penalty time.Duration) *resolverScores {
+	if penalty <= 0 {
+		penalty = defaultErrorPenalty
+	}
+	return &resolverScores{
+		scores:  make(map[*Resolver]*resolverScore),
+		penalty: penalty.Seconds(),
+	}
+}
+
+// observe updates the score of r by a lookup taking rtt, which fails if err is not nil.
+func (rs *resolverScores) observe(r *Resolver, rtt time.Duration, err error) {
+	if rs == nil {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	var failed float64
+	if err != nil {
+		failed = 1
+	}
+	score := rs.scores[r]
+	if score == nil {
+		score = &resolverScore{ErrRate: failed}
+		rs.scores[r] = score
+	} else {
+		score.ErrRate = scoreWeight*failed + (1-scoreWeight)*score.ErrRate
+	}
+	if err != nil {
+		return
+	}
+	if !score.rttSeen {
+		score.RTT, score.rttSeen = rtt.Seconds(), true
+		return
+	}
+	score.RTT = scoreWeight*rtt.Seconds() + (1-scoreWeight)*score.RTT
+}
+
+// observeCanceled updates the score of r by a lookup canceled after elapsed, which is a lower bound of its RTT.
+// The error rate is not changed.
+func (rs *resolverScores) observeCanceled(r *Resolver, elapsed time.Duration) {
+	if rs == nil {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	score := rs.scores[r]
+	if score == nil {
+		score = new(resolverScore)
+		rs.scores[r] = score
+	}
+	switch {
+	case !score.rttSeen:
+		score.RTT, score.rttSeen = elapsed.Seconds(), true
+	case elapsed.Seconds() > score.RTT:
+		score.RTT = scoreWeight*elapsed.Seconds() + (1-scoreWeight)*score.RTT
+	}
+}
+
+// cost returns the expected time in seconds to get a reply from r, where a failed lookup costs the penalty.
+// It returns false if r has never been observed.
+func (rs *resolverScores) cost(r *Resolver) (float64, bool) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	score := rs.scores[r]
+	if score == nil {
+		return 0, false
+	}
+	return (1-score.ErrRate)*score.RTT + score.ErrRate*rs.penalty, true
+}
+
+// sort returns a copy of resolvers ordered by cost. Resolvers never observed come first in their original order,
+// so that they get a chance to be measured.
+func (rs *resolverScores) sort(resolvers resolverList) resolverList {
+	if rs == nil || len(resolvers) < 2 {
+		return resolvers
+	}
+	type scored struct {
+		resolver *Resolver
+		cost     float64
+		ok       bool
+	}
+	list := make([]scored, len(resolvers))
+	for i, r := range resolvers {
+		list[i].resolver = r
+		list[i].cost, list[i].ok = rs.cost(r)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].ok != list[j].ok {
+			return !list[i].ok
+		}
+		return list[i].cost < list[j].cost
+	})
+
+	sorted := make(resolverList, len(list))
+	for i, s := range list {
+		sorted[i] = s.resolver
+	}
+	return sorted
+}
@@ -0,0 +1,69 @@
+package gochinadns
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResolverScores(t *testing.T) {
+	var nilScores *resolverScores
+	r1, r2, r3, r4 := &Resolver{Addr: "1"}, &Resolver{Addr: "2"}, &Resolver{Addr: "3"}, &Resolver{Addr: "4"}
+	resolvers := resolverList{r1, r2, r3, r4}
+	nilScores.observe(r1, time.Second, nil)
+	if sorted := nilScores.sort(resolvers); !reflect.DeepEqual(sorted, resolvers) {
+		t.Errorf("Disabled scoring should keep the order, got %v", sorted)
+	}
+
+	scores := newResolverScores(time.Second)
+	scores.observe(r1, 300*time.Millisecond, nil)
+	scores.observe(r2, 100*time.Millisecond, nil)
+	scores.observe(r3, 0, errors.New("timeout"))
+	if want := (resolverList{r4, r2, r1, r3}); !reflect.DeepEqual(scores.sort(resolvers), want) {
+		t.Errorf("Resolvers should be sorted as %v, got %v", want, scores.sort(resolvers))
+	}
+
+	// r2 gets slower and fails, and r1 keeps fast.
+	for i := 0; i < 10; i++ {
+		scores.observe(r1, 50*time.Millisecond, nil)
+		scores.observe(r2, 500*time.Millisecond, nil)
+	}
+	scores.observe(r2, 0, errors.New("timeout"))
+	if want := (resolverList{r4, r1, r2, r3}); !reflect.DeepEqual(scores.sort(resolvers), want) {
+		t.Errorf("Resolvers should be sorted as %v, got %v", want, scores.sort(resolvers))
+	}
+
+	cost, ok := scores.cost(r2)
+	rtt := 0.1*math.Pow(0.8, 10) + 0.5*(1-math.Pow(0.8, 10))
+	if want := 0.8*rtt + 0.2*1; !ok || math.Abs(cost-want) > 1e-9 {
+		t.Errorf("Cost of r2 should be %f, got %f", want, cost)
+	}
+	if _, ok := scores.cost(r4); ok {
+		t.Error("Resolver never observed should have no cost")
+	}
+	if !reflect.DeepEqual(resolvers, resolverList{r1, r2, r3, r4}) {
+		t.Error("Resolvers should not be sorted in place")
+	}
+}
+
+func TestResolverScoresObserveCanceled(t *testing.T) {
+	r1, r2 := &Resolver{Addr: "1"}, &Resolver{Addr: "2"}
+	scores := newResolverScores(time.Second)
+	scores.observe(r2, 10*time.Millisecond, nil)
+	scores.observeCanceled(r1, 50*time.Millisecond)
+	if want := (resolverList{r2, r1}); !reflect.DeepEqual(scores.sort(resolverList{r1, r2}), want) {
+		t.Errorf("Resolver canceled should be measured and sorted as %v, got %v", want, scores.sort(resolverList{r1, r2}))
+	}
+	if cost, _ := scores.cost(r1); math.Abs(cost-0.05) > 1e-9 {
+		t.Errorf("Cost of resolver canceled should be the elapsed time, got %f", cost)
+	}
+
+	// a shorter elapsed time is not a lower bound of a known RTT.
+	scores.observeCanceled(r1, 10*time.Millisecond)
+	scores.observeCanceled(r1, 100*time.Millisecond)
+	if cost, _ := scores.cost(r1); math.Abs(cost-0.06) > 1e-9 {
+		t.Errorf("Cost of resolver canceled should be 0.06, got %f", cost)
+	}
+}
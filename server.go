@@ -2,24 +2,41 @@ package gochinadns
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
-	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cherrot/gochinadns/hosts"
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
 // Server represents a DNS Server instance
 type Server struct {
 	*serverOptions
 	*Client
-	UDPServer *dns.Server
-	TCPServer *dns.Server
+	UDPServer     *dns.Server
+	TCPServer     *dns.Server
+	MetricsServer *http.Server // nil if metrics are disabled
+	cache         *lruCache
+	metrics       *metrics
+	queryLog      *queryLog
+	inflight      singleflight.Group // coalesces identical in-flight queries
+	rules         atomic.Pointer[ruleLists]
+	ranks         atomic.Pointer[resolverRanks] // resolvers in use, re-ranked by health checks
+	scores        *resolverScores               // nil if scoring is disabled
+	ctx           context.Context               // canceled on shutdown to abort upstream lookups
+	cancel        context.CancelFunc
+
+	prefetched     uint64 // number of prefetched cache entries
+	prefetchFailed uint64 // number of failed prefetches
 }
 
 // NewServer creates a new server instance
@@ -37,31 +54,143 @@ func NewServer(cli *Client, opts ...ServerOption) (s *Server, err error) {
 		UDPServer:     &dns.Server{Addr: o.Listen, Net: "udp", ReusePort: o.ReusePort},
 		TCPServer:     &dns.Server{Addr: o.Listen, Net: "tcp", ReusePort: o.ReusePort},
 	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.rules.Store(newRuleLists(o))
 	s.UDPServer.Handler = dns.HandlerFunc(s.Serve)
 	s.TCPServer.Handler = dns.HandlerFunc(s.Serve)
+	if !o.CacheDisabled && o.CacheEntries > 0 {
+		s.cache = newLRUCache(o.CacheEntries, o.CacheTTL, o.LazyExpire)
+		s.cache.prefetchHits, s.cache.prefetchWindow = o.PrefetchHits, o.PrefetchWindow
+		s.cache.negativeMaxTTL = o.NegativeMaxTTL
+	}
+	if !o.ScoringDisabled {
+		s.scores = newResolverScores(cli.Timeout)
+	}
+	if o.QueryLog != "" {
+		s.queryLog = newQueryLog(o.QueryLog, o.QueryLogMaxSize, o.QueryLogBackups, o.QueryLogMaxAge)
+	}
+	if o.MetricsListen != "" {
+		s.metrics = newMetrics()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", s.metrics.Handler())
+		s.MetricsServer = &http.Server{Addr: o.MetricsListen, Handler: mux}
+	}
 
 	if err = s.partitionResolvers(); err != nil {
 		s = nil
 		return
 	}
+	s.storeRanks()
+	if err = s.checkDomainRoutes(o.DomainRoutes); err != nil {
+		s = nil
+		return
+	}
 	if !s.SkipRefine {
 		s.refineResolvers()
+		s.storeRanks()
 	}
 	return
 }
 
-// Run start the default DNS server.
-func (s *Server) Run() error {
+// storeRanks ranks all trusted and untrusted resolvers in their current order.
+func (s *Server) storeRanks() {
+	s.ranks.Store(&resolverRanks{Trusted: s.TrustedServers, Untrusted: s.UntrustedServers})
+}
+
+// Run starts the DNS server, and the metrics server and health checks if enabled. It blocks until ctx is done, Shutdown is called,
+// or any of the servers fails. When ctx is done, the server is shut down by Shutdown within ShutdownTimeout.
+// If any of the servers fails, the others are stopped and the error is returned, and Run can be called again.
+func (s *Server) Run(ctx context.Context) error {
 	logrus.Info("Start server at ", s.Listen)
-	eg, _ := errgroup.WithContext(context.Background())
-	eg.Go(s.UDPServer.ListenAndServe)
-	eg.Go(s.TCPServer.ListenAndServe)
+	eg, egCtx := errgroup.WithContext(ctx)
+	// ready is done once every DNS server is started or fails to start, so that it can be stopped.
+	var ready sync.WaitGroup
+	for _, srv := range []*dns.Server{s.UDPServer, s.TCPServer} {
+		srv, once := srv, new(sync.Once)
+		ready.Add(1)
+		srv.NotifyStartedFunc = func() { once.Do(ready.Done) }
+		eg.Go(func() error {
+			defer once.Do(ready.Done)
+			return srv.ListenAndServe()
+		})
+	}
+	if s.HealthInterval > 0 {
+		eg.Go(func() error {
+			s.CheckHealth(egCtx)
+			return nil
+		})
+	}
+	metricsServer := s.MetricsServer
+	if metricsServer != nil {
+		logrus.Info("Start metrics server at ", s.MetricsListen)
+		eg.Go(func() error {
+			if err := metricsServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		})
+	}
+
+	eg.Go(func() error {
+		select {
+		case <-s.ctx.Done(): // shut down by Shutdown
+			return nil
+		case <-egCtx.Done():
+		}
+		ready.Wait()
+		sctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+		defer cancel()
+		if ctx.Err() != nil {
+			logrus.Info("Shut down server.")
+			return s.Shutdown(sctx)
+		}
+		return s.stop(sctx)
+	})
+	err := eg.Wait()
+
+	if metricsServer != nil && s.ctx.Err() == nil {
+		// http.Server can not be started again after shut down.
+		s.MetricsServer = &http.Server{Addr: metricsServer.Addr, Handler: metricsServer.Handler}
+	}
+	return err
+}
+
+// Shutdown gracefully shuts down the server. It stops listening, and waits for in-flight queries until ctx is done.
+// Then outstanding upstream lookups are canceled, and the query log is closed.
+// The server can not be run again after Shutdown.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.stop(ctx)
+	s.cancel()
+	if e := s.queryLog.Close(); e != nil {
+		logrus.WithError(e).Error("Fail to close query log.")
+	}
+	return err
+}
+
+// stop stops the DNS servers and the metrics server, and waits for in-flight queries until ctx is done.
+func (s *Server) stop(ctx context.Context) error {
+	var eg errgroup.Group
+	for _, srv := range []*dns.Server{s.UDPServer, s.TCPServer} {
+		srv := srv
+		eg.Go(func() error {
+			// the error is ignored if srv is not started at all
+			if err := srv.ShutdownContext(ctx); err != nil && ctx.Err() != nil {
+				return err
+			}
+			return nil
+		})
+	}
+	if s.MetricsServer != nil {
+		eg.Go(func() error {
+			return s.MetricsServer.Shutdown(ctx)
+		})
+	}
 	return eg.Wait()
 }
 
 // partitionResolvers partitions resolvers into untrusted and trusted separately
-// If a DoH server is not in an IP format, and it's hostname is not in system's hosts file (e.g. /etc/hosts),
-// I will treat it a trusted server by default.
+// If a DoH server is not in an IP format, it has no bootstrap IPs, and it's hostname is not in system's hosts file
+// (e.g. /etc/hosts), I will treat it a trusted server by default.
 func (s *Server) partitionResolvers() error {
 	for _, resolver := range s.Servers {
 		var (
@@ -69,11 +198,11 @@ func (s *Server) partitionResolvers() error {
 			err error
 		)
 		if len(resolver.GetProtocols()) == 1 && resolver.GetProtocols()[0] == "doh" {
-			if ip, err = s.resolveDoHAddr(resolver.GetAddr()); err != nil {
+			if ip, err = s.resolveDoHAddr(resolver); err != nil {
 				return err
 			}
 			if ip == nil {
-				logrus.Warnf("I can't find IP for [%s] in system's hosts file, trust it by default.", resolver.GetAddr())
+				logrus.Warnf("I can't find IP for [%s] in bootstrap IPs or system's hosts file, trust it by default.", resolver.GetAddr())
 				s.TrustedServers = uniqueAppendResolver(s.TrustedServers, resolver)
 				continue
 			}
@@ -98,66 +227,45 @@ func (s *Server) partitionResolvers() error {
 	return nil
 }
 
+// refineResolvers tests trusted and untrusted resolvers with TestDomains by Client.Lookup within RefineTimeout,
+// and sorts them by error rate and average RTT. Listening servers are not started during the test.
 func (s *Server) refineResolvers() {
-	type test struct {
-		server *Resolver
-		errCnt int
-		rttAvg time.Duration
-	}
-
-	logrus.Infoln("Start server temporarily to refine resolvers' order.")
-	go s.UDPServer.ListenAndServe() //nolint:errcheck
-	go s.TCPServer.ListenAndServe() //nolint:errcheck
+	const _loop = 3
+	start := time.Now()
+	logrus.WithField("timeout", s.RefineTimeout).Info("Refine resolvers' order.")
 
-	refine := func(resolvers resolverList) (availLen int) {
-		const _loop = 3
-		availLen = len(resolvers)
-		var (
-			tests = make([]test, availLen)
-			req   = new(dns.Msg)
-		)
-		for i, rs := range resolvers {
-			tests[i].server = rs
-			for j := 0; j < _loop; j++ {
-				for _, name := range s.TestDomains {
-					req.SetQuestion(dns.Fqdn(name), dns.TypeA)
-					_, rtt, err := s.Lookup(req, rs)
-					if err != nil {
-						tests[i].errCnt++
-						continue
-					}
-					tests[i].rttAvg += rtt
-				}
-			}
-			if tests[i].rttAvg > 0 {
-				tests[i].rttAvg /= time.Duration(_loop*len(s.TestDomains) - tests[i].errCnt)
+	refine := func(group string, resolvers resolverList) (refined resolverList, availLen int) {
+		for _, st := range s.testResolvers(resolvers, _loop, s.RefineTimeout) {
+			refined = append(refined, st.Resolver)
+			if st.healthy() {
+				availLen++
 			}
-			if tests[i].errCnt > _loop*len(s.TestDomains)/2 {
-				availLen--
-			}
-			logrus.Infof("%s: average RTT %s with %d errors.", rs, tests[i].rttAvg, tests[i].errCnt)
+			logrus.WithFields(logrus.Fields{
+				"group":    group,
+				"resolver": st.Resolver,
+				"rtt":      st.RTT,
+				"queries":  st.Queries,
+				"errors":   st.Errors,
+			}).Info("Resolver tested.")
 		}
-
-		// sort resolvers in place based on tests
-		sort.Slice(resolvers, func(i, j int) bool {
-			if tests[i].errCnt == tests[j].errCnt {
-				return tests[i].rttAvg < tests[j].rttAvg
-			}
-			return tests[i].errCnt < tests[j].errCnt
-		})
-
-		return availLen
+		return
 	}
-	
 
-	t := make(resolverList, len(s.TrustedServers))
-	un := make(resolverList, len(s.UntrustedServers))
-	copy(t, s.TrustedServers)
-	copy(un, s.UntrustedServers)
-	availTrusted, availUntrusted := refine(t), refine(un)
-
-	_ = s.UDPServer.Shutdown()
-	_ = s.TCPServer.Shutdown()
+	var (
+		wg                           sync.WaitGroup
+		t, un                        resolverList
+		availTrusted, availUntrusted int
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		t, availTrusted = refine(groupTrusted, s.TrustedServers)
+	}()
+	go func() {
+		defer wg.Done()
+		un, availUntrusted = refine(groupUntrusted, s.UntrustedServers)
+	}()
+	wg.Wait()
 	s.TrustedServers, s.UntrustedServers = t, un
 
 	if availTrusted == 0 {
@@ -167,11 +275,17 @@ func (s *Server) refineResolvers() {
 		logrus.Error("All untrusted resolvers test failed. Server may not behave properly in bidirectional mode.")
 	}
 
-	logrus.Info("Refined trusted resolvers: ", s.TrustedServers)
-	logrus.Info("Refined untrusted resolvers: ", s.UntrustedServers)
+	logrus.WithFields(logrus.Fields{
+		"trusted":             s.TrustedServers,
+		"trusted_available":   availTrusted,
+		"untrusted":           s.UntrustedServers,
+		"untrusted_available": availUntrusted,
+		"elapsed":             time.Since(start),
+	}).Info("Resolvers refined.")
 }
 
-func (s *Server) resolveDoHAddr(addr string) (net.IP, error) {
+func (s *Server) resolveDoHAddr(resolver *Resolver) (net.IP, error) {
+	addr := resolver.GetAddr()
 	u, err := url.Parse(addr)
 	if err != nil {
 		return nil, err
@@ -185,6 +299,10 @@ func (s *Server) resolveDoHAddr(addr string) (net.IP, error) {
 		return ip, nil
 	}
 
+	if bootstrap := resolver.GetBootstrap(); len(bootstrap) > 0 {
+		return net.ParseIP(bootstrap[0]), nil
+	}
+
 	if ip := hosts.Lookup(host); ip != nil {
 		return ip, nil
 	}
@@ -0,0 +1,144 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// freeAddr returns a local address whose port is free at the moment.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// waitServing waits until the DNS server at addr answers queries.
+func waitServing(t *testing.T, addr string) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	cli := &dns.Client{Net: "tcp", Timeout: 100 * time.Millisecond}
+	for i := 0; i < 50; i++ {
+		if _, _, err := cli.Exchange(req, addr); err == nil {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("Server is not serving at ", addr)
+}
+
+func TestServerRunShutdown(t *testing.T) {
+	upstream := startUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(200 * time.Millisecond)
+		answerA(w, req, "1.1.1.1")
+	})
+
+	addr := freeAddr(t)
+	s, err := NewServer(NewClient(WithTimeout(time.Second)),
+		WithListenAddr(addr),
+		WithTrustedResolvers(false, upstream),
+		WithDisableCache(true),
+		WithDelay(time.Second),
+		WithSkipRefineResolvers(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	waitServing(t, addr)
+
+	replied := make(chan *dns.Msg, 1)
+	go func() {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		reply, _ := dns.Exchange(req, addr)
+		replied <- reply
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	if reply := <-replied; reply == nil || len(reply.Answer) != 1 {
+		t.Errorf("In-flight query should be answered on shutdown, got %v", reply)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run should return nil on shutdown, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run should return on shutdown")
+	}
+	if s.ctx.Err() == nil {
+		t.Error("Upstream lookups should be canceled on shutdown")
+	}
+}
+
+func TestServerRunFailure(t *testing.T) {
+	addr := freeAddr(t)
+	occupied, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(NewClient(), WithListenAddr(addr), WithSkipRefineResolvers(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Run(context.Background()) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Run should fail if the address is in use")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run should stop the other servers and return if any of them fails")
+	}
+
+	occupied.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { done <- s.Run(ctx) }()
+	waitServing(t, addr)
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Run should be able to run again after failure, got %v", err)
+	}
+}
+
+func TestServerRunHealthCheck(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	s, err := NewServer(NewClient(WithTimeout(50*time.Millisecond)),
+		WithListenAddr(freeAddr(t)),
+		WithTrustedResolvers(false, "udp@"+startUpstream(t, flakyHandler(&down)), "udp@"+startUpstream(t, flakyHandler(new(atomic.Bool)))),
+		WithHealthCheck(100*time.Millisecond),
+		WithSkipRefineResolvers(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	for i := 0; i < 50 && len(s.ranks.Load().Trusted) == 2; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if trusted := s.ranks.Load().Trusted; len(trusted) != 1 {
+		t.Errorf("Failing resolver should be ejected by health checks started by Run, got %v", trusted)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run should stop health checks on shutdown")
+	}
+}
@@ -1,25 +1,92 @@
 package gochinadns
 
 import (
+	"fmt"
+	"regexp"
 	"strings"
 )
 
+// domainTrie is a set of domain rules, or a map from domain suffixes to values if built by Set.
 type domainTrie struct {
 	children map[string]*domainTrie
-	end      bool
+	end      bool // matches the domain and its subdomains
+	full     bool // matches the domain only
+	value    string
+	extra    *domainRules // rules other than domain suffixes, only used at root
 }
 
-func (tr *domainTrie) Add(domain string) {
-	domain = strings.TrimSpace(domain)
-	if domain == "" {
-		return
+// domainRules contains rules which can not be stored in trie nodes.
+type domainRules struct {
+	keywords   []string
+	regexps    []*regexp.Regexp
+	exceptions *domainTrie
+}
+
+// Add adds a rule to the trie. A rule is a domain, which matches the domain and its subdomains,
+// or a domain prefixed by `domain:` which is the same, or one of:
+//
+//	full:example.com     matches example.com only
+//	keyword:example      matches domains containing example
+//	regexp:^ad[0-9]+\.   matches domains by regular expression
+//
+// Rules prefixed by `@@` are exceptions. Domains matching any exception are never contained in the trie,
+// e.g. `@@cdn.ads.example.com` allows cdn.ads.example.com and its subdomains even if `ads.example.com` is added.
+func (tr *domainTrie) Add(rule string) error {
+	rule = strings.TrimSpace(rule)
+	if rule == "" {
+		return nil
+	}
+	if exception := strings.TrimPrefix(rule, "@@"); exception != rule {
+		r := tr.rules()
+		if r.exceptions == nil {
+			r.exceptions = new(domainTrie)
+		}
+		return r.exceptions.Add(exception)
 	}
 
-	domain = strings.Trim(domain, ".")
+	kind, value, ok := strings.Cut(rule, ":")
+	if !ok {
+		kind, value = "domain", rule
+	}
+	switch kind {
+	case "domain":
+		tr.addDomain(value, false)
+	case "full":
+		tr.addDomain(value, true)
+	case "keyword":
+		if value != "" {
+			r := tr.rules()
+			r.keywords = append(r.keywords, value)
+		}
+	case "regexp":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return fmt.Errorf("invalid domain rule %q: %w", rule, err)
+		}
+		r := tr.rules()
+		r.regexps = append(r.regexps, re)
+	default:
+		return fmt.Errorf("invalid domain rule %q: unknown type %s", rule, kind)
+	}
+	return nil
+}
+
+func (tr *domainTrie) rules() *domainRules {
+	if tr.extra == nil {
+		tr.extra = new(domainRules)
+	}
+	return tr.extra
+}
+
+// addDomain adds domain and its subdomains to the trie, or domain itself only if full is true.
+func (tr *domainTrie) addDomain(domain string, full bool) {
+	domain = strings.Trim(strings.TrimSpace(domain), ".")
 	// "." contains all domains
 	if domain == "" {
-		tr.end = true
-		tr.children = nil
+		if !full {
+			tr.end = true
+			tr.children = nil
+		}
 		return
 	}
 
@@ -40,14 +107,26 @@ func (tr *domainTrie) Add(domain string) {
 		}
 		node = node.children[label]
 	}
-	node.end = true
+	if full {
+		node.full = true
+	} else {
+		node.end = true
+	}
 }
 
+// Contain reports whether domain matches any rule and no exception in the trie.
 func (tr *domainTrie) Contain(domain string) bool {
 	if tr == nil {
 		return false
 	}
 	domain = strings.Trim(domain, ".")
+	if !tr.match(domain) {
+		return false
+	}
+	return tr.extra == nil || !tr.extra.exceptions.Contain(domain)
+}
+
+func (tr *domainTrie) match(domain string) bool {
 	labels := strings.Split(domain, ".")
 	node := tr
 	if node.end {
@@ -57,12 +136,87 @@ func (tr *domainTrie) Contain(domain string) bool {
 		label := labels[i]
 		node = node.children[label]
 		if node == nil {
-			return false
+			break
 		}
-		if node.end {
+		if node.end || (i == 0 && node.full) {
+			return true
+		}
+	}
+
+	if tr.extra == nil {
+		return false
+	}
+	for _, keyword := range tr.extra.keywords {
+		if strings.Contains(domain, keyword) {
+			return true
+		}
+	}
+	for _, re := range tr.extra.regexps {
+		if re.MatchString(domain) {
 			return true
 		}
 	}
-	// should not be here
 	return false
 }
+
+// Set maps domain and its subdomains to value. Unlike Add, subdomains already in the trie are kept,
+// so that the longest matching suffix wins in Get.
+func (tr *domainTrie) Set(domain, value string) {
+	domain = strings.Trim(strings.TrimSpace(domain), ".")
+	node := tr
+	if domain != "" {
+		labels := strings.Split(domain, ".")
+		for i := len(labels) - 1; i >= 0; i-- {
+			if node.children == nil {
+				node.children = make(map[string]*domainTrie)
+			}
+			label := labels[i]
+			if node.children[label] == nil {
+				node.children[label] = new(domainTrie)
+			}
+			node = node.children[label]
+		}
+	}
+	node.end = true
+	node.value = value
+}
+
+// Get returns the value of the longest suffix of domain set by Set.
+func (tr *domainTrie) Get(domain string) (value string, ok bool) {
+	if tr == nil {
+		return "", false
+	}
+	node := tr
+	if node.end {
+		value, ok = node.value, true
+	}
+	domain = strings.Trim(domain, ".")
+	if domain == "" {
+		return
+	}
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		node = node.children[labels[i]]
+		if node == nil {
+			return
+		}
+		if node.end {
+			value, ok = node.value, true
+		}
+	}
+	return
+}
+
+// Values returns all values set in the trie, which may contain duplicates.
+func (tr *domainTrie) Values() (values []string) {
+	if tr == nil {
+		return nil
+	}
+	if tr.end {
+		values = append(values, tr.value)
+	}
+	for _, child := range tr.children {
+		values = append(values, child.Values()...)
+	}
+	return
+}
@@ -2,6 +2,7 @@ package gochinadns
 
 import (
 	"reflect"
+	"sort"
 	"testing"
 )
 
@@ -73,3 +74,82 @@ func TestTrieContain(t *testing.T) {
 		t.Error("cn should contain all .cn domains")
 	}
 }
+
+func TestTrieGet(t *testing.T) {
+	trie := new(domainTrie)
+	if _, ok := trie.Get("google.com"); ok {
+		t.Error("An empty trie contains nothing")
+	}
+
+	trie.Set("example.com", "a")
+	trie.Set("corp.example.com.", "b")
+	tests := map[string]string{
+		"example.com":           "a",
+		"www.example.com.":      "a",
+		"corp.example.com":      "b",
+		"host.corp.example.com": "b",
+		"com":                   "",
+		"google.com":            "",
+	}
+	for domain, want := range tests {
+		if got, _ := trie.Get(domain); got != want {
+			t.Errorf("Value of %s should be %q, got %q", domain, want, got)
+		}
+	}
+
+	trie.Set(".", "c")
+	if got, _ := trie.Get("google.com"); got != "c" {
+		t.Errorf("A dot should match any domain name, got %q", got)
+	}
+	if got, _ := trie.Get("corp.example.com"); got != "b" {
+		t.Errorf("The longest suffix should win, got %q", got)
+	}
+	values := trie.Values()
+	sort.Strings(values)
+	if !reflect.DeepEqual(values, []string{"a", "b", "c"}) {
+		t.Errorf("Values should be [a b c], got %v", values)
+	}
+}
+
+func TestTrieRules(t *testing.T) {
+	trie := new(domainTrie)
+	for _, rule := range []string{
+		"ads.example.com",
+		"@@cdn.ads.example.com",
+		"full:example.org",
+		"keyword:tracker",
+		"regexp:^ad[0-9]+\\.",
+		"@@full:ad1.example.net",
+	} {
+		if err := trie.Add(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := map[string]bool{
+		"ads.example.com":         true,
+		"x.ads.example.com":       true,
+		"cdn.ads.example.com":     false,
+		"img.cdn.ads.example.com": false,
+		"example.org":             true,
+		"example.org.":            true,
+		"www.example.org":         false,
+		"org":                     false,
+		"tracker.example.net":     true,
+		"mytracker.io":            true,
+		"ad2.example.net":         true,
+		"ad1.example.net":         false,
+		"x.ad1.example.net":       false,
+		"bad1.example.net":        false,
+	}
+	for domain, want := range tests {
+		if got := trie.Contain(domain); got != want {
+			t.Errorf("Contain(%s) should be %v, got %v", domain, want, got)
+		}
+	}
+
+	for _, rule := range []string{"regexp:(", "unknown:example.com"} {
+		if err := trie.Add(rule); err == nil {
+			t.Errorf("Adding invalid rule %s should fail", rule)
+		}
+	}
+}